@@ -2,16 +2,26 @@ package awseventadapter
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -21,7 +31,8 @@ import (
 const (
 	// CustomHostVariable is the name of the environment variable that contains
 	// the custom hostname for the request. If this variable is not set the framework
-	// reverts to `DefaultServerAddress`. The value for a custom host should include
+	// reverts to `DefaultServerAddress`. The ServerAddress option takes
+	// precedence over both. The value for a custom host should include
 	// a protocol: http://my-custom.host.com
 	CustomHostVariable = "GO_API_HOST"
 
@@ -30,17 +41,101 @@ const (
 
 	// APIGwContextHeader is the custom header key used to store the
 	// API Gateway context. To access the Context properties use the
-	// GetAPIGatewayContext method of the RequestAccessor object.
+	// GetAPIGatewayContext function.
 	APIGwContextHeader = "X-GoLambdaProxy-ApiGw-Context"
 
 	// APIGwStageVarsHeader is the custom header key used to store the
 	// API Gateway stage variables. To access the stage variable values
-	// use the GetAPIGatewayStageVars method of the RequestAccessor object.
+	// use the GetAPIGatewayStageVars function.
 	APIGwStageVarsHeader = "X-GoLambdaProxy-ApiGw-StageVars"
 
 	contentTypeHeaderKey = "Content-Type"
 )
 
+// ErrUnsupportedMethod is returned by ToRequest for HTTP methods that make no
+// sense without a real connection behind the request, like CONNECT
+var ErrUnsupportedMethod = errors.New("Unsupported HTTP method")
+
+// ErrEmptyPath is returned by ToRequest for events without a path when the
+// RejectEmptyPath option is set
+var ErrEmptyPath = errors.New("Request has an empty path")
+
+// ErrInvalidBase64Body is returned when a body flagged as base64 doesn't
+// decode, including when it's truncated and streamed to the handler
+var ErrInvalidBase64Body = errors.New("Invalid base64 body")
+
+// ErrInvalidGzipBody is returned when the DecompressRequests option is set and
+// a body declared as gzip doesn't decompress
+var ErrInvalidGzipBody = errors.New("Invalid gzip body")
+
+// ErrBodyNotAllowed is returned for a 204 response carrying a body when the
+// StrictNoContent option is set
+var ErrBodyNotAllowed = errors.New("Response status does not allow a body")
+
+// ErrResponseTooLarge is returned for a response body bigger than the
+// MaxResponseSize option allows
+var ErrResponseTooLarge = errors.New("Response body too large")
+
+// ErrHijackNotSupported is returned to a handler calling Hijack, a Lambda
+// invocation has no connection to take over
+var ErrHijackNotSupported = errors.New("Hijacking the connection is not supported")
+
+// ErrTooManyHeaders is returned for a response with more headers than the
+// MaxResponseHeaderCount option allows
+var ErrTooManyHeaders = errors.New("Response has too many headers")
+
+// unsupportedMethods are rejected with ErrUnsupportedMethod
+var unsupportedMethods = []string{
+	http.MethodConnect,
+}
+
+// hopByHopHeaders only mean something for a single connection, there isn't
+// one between the handler and the client so they're stripped from responses
+// https://tools.ietf.org/html/rfc7230#section-6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// strippedRequestHeaders are removed from incoming requests, they negotiate
+// with a connection the handler doesn't have. TE is hop by hop and net/http
+// reads it as a promise from the client about trailers.
+var strippedRequestHeaders = []string{
+	"Expect",
+	"Te",
+}
+
+// defaultSingleValueHeaders are the response headers collapsed to one value
+// when the SingleValueHeaders option isn't set
+var defaultSingleValueHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"Location",
+}
+
+// defaultBinaryContentTypes are the response content types always base64
+// encoded, even when the body happens to pass the utf8 check, when the
+// BinaryContentTypes option isn't set. Some PDFs are mostly text and slip
+// through otherwise. Entries ending in / match every subtype but the +xml and
+// +json ones, so image/svg+xml stays text.
+var defaultBinaryContentTypes = []string{
+	"application/pdf",
+	"application/octet-stream",
+	"application/zip",
+	"application/gzip",
+	"image/",
+	"audio/",
+	"video/",
+	"font/",
+}
+
 // AdapterRequest is a struct that contains fields required to produce either
 // an events.APIGatewayResponse or events.ALBTargetGroupResponse
 type AdapterRequest struct {
@@ -56,7 +151,18 @@ type AdapterRequest struct {
 	RequestContext                  interface{}         `json:"requestContext"`
 	Body                            string              `json:"body"`
 	IsBase64Encoded                 bool                `json:"isBase64Encoded,omitempty"`
-	stripBasePath                   string
+
+	// HTTP API payload format 2.0 fields. The method lives in
+	// `requestContext.http.method`, and the raw query string is passed on
+	// exactly as the client sent it, only StripQueryParameters applies to it.
+	// Being still encoded, a + in it decodes as a space.
+	Version        string   `json:"version,omitempty"`
+	RawPath        string   `json:"rawPath,omitempty"`
+	RawQueryString string   `json:"rawQueryString,omitempty"`
+	Cookies        []string `json:"cookies,omitempty"`
+
+	stripBasePath string
+	options       *AdapterOptions
 }
 
 // According to the docs, defer in a wrapped handler will fire after the request has
@@ -76,42 +182,331 @@ func requestDoneHandler(h http.Handler, ch chan struct{}) http.Handler {
 // Proxy takes the handler from your flavor of framework and processes it into
 // an AdapterResponse which can be cast to the required event.Response type
 func (ar *AdapterRequest) Proxy(ctx context.Context, handler http.Handler) (*AdapterResponse, error) {
+	aresp, err := ar.proxy(ctx, handler)
+	if capture := ar.opts().Capture; capture != nil && aresp != nil {
+		capture(ar, aresp)
+	}
+	return aresp, err
+}
+
+// proxy is Proxy without the Capture hook
+func (ar *AdapterRequest) proxy(ctx context.Context, handler http.Handler) (*AdapterResponse, error) {
+	opts := ar.opts()
+	// Worked out up front so the responses the adapter builds itself carry
+	// it too
+	correlationID := ar.correlationID(opts.CorrelationHeader)
+	if opts.Ready != nil && !opts.Ready() {
+		retryAfter := opts.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		return ar.errorResponse(http.StatusServiceUnavailable, "Not ready", correlationID, http.Header{
+			"Retry-After": {strconv.Itoa(seconds)},
+		})
+	}
+
+	if aresp, ok, err := ar.preflightResponse(); ok {
+		return aresp, err
+	}
+
 	httpRequest, err := ar.ToRequest()
 	if err != nil {
+		if opts.RequestErrorResponses {
+			return ar.errorResponse(http.StatusBadRequest, err.Error(), correlationID, nil)
+		}
 		return nil, errors.Wrap(err, "Unable to convert AdapterRequest to http.Request")
 	}
-	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest = httpRequest.WithContext(ar.withContextValues(ctx))
+	httpRequest = withCorrelationID(httpRequest, opts.CorrelationHeader, correlationID)
+
+	timeout := opts.routeTimeout(httpRequest.URL.Path)
+	margin := opts.deadlineMargin()
+	resp, sniff, err := serveHTTP(handler, httpRequest, timeout, margin, !opts.PropagatePanics)
+	if err == errHandlerTimeout || err == errInvocationDeadline {
+		switch {
+		case ctx.Err() == context.Canceled:
+			log.Printf("Handler for %s %s was still running when the invocation was cancelled\n", httpRequest.Method, httpRequest.URL.Path)
+		case err == errInvocationDeadline:
+			log.Printf("Handler for %s %s was still running %s before the invocation deadline\n", httpRequest.Method, httpRequest.URL.Path, margin)
+		default:
+			log.Printf("Handler for %s %s exceeded its %s timeout\n", httpRequest.Method, httpRequest.URL.Path, timeout)
+		}
+		return ar.errorResponse(http.StatusGatewayTimeout, "Handler timed out", correlationID, nil)
+	}
+	if err == errHandlerHijacked {
+		log.Printf("Handler for %s %s tried to hijack the connection\n", httpRequest.Method, httpRequest.URL.Path)
+		return ar.errorResponse(http.StatusInternalServerError, "Hijacking the connection is not supported", correlationID, nil)
+	}
+	if p, ok := err.(*handlerPanic); ok {
+		log.Printf("Handler for %s %s panicked: %v\n%s", httpRequest.Method, httpRequest.URL.Path, p.value, p.stack)
+		return ar.errorResponse(http.StatusInternalServerError, "Internal server error", correlationID, nil)
+	}
+	if correlationID != "" && resp.Header.Get(opts.CorrelationHeader) == "" {
+		resp.Header.Set(opts.CorrelationHeader, correlationID)
+	}
+	if opts.RewriteLocation {
+		ar.rewriteLocation(resp.Header)
+	}
+	ar.corsHeaders(resp.Header)
+
+	aresp, err := newAdapterResponse(resp, sniff, opts)
+	if errors.Cause(err) == ErrResponseTooLarge && opts.ResponseTooLargeResponses {
+		log.Printf("Response for %s %s: %v\n", httpRequest.Method, httpRequest.URL.Path, err)
+		return ar.errorResponse(http.StatusRequestEntityTooLarge, "Response too large", correlationID, nil)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to convert http.Response into AdapterResponse")
+	}
+
+	return aresp, nil
+}
+
+// serverAddress returns the scheme and host ToRequest gives every request, the
+// ServerAddress option, then the CustomHostVariable, then DefaultServerAddress.
+// It reports whether the address was configured rather than the default.
+func (o *AdapterOptions) serverAddress() (string, bool) {
+	if o.ServerAddress != "" {
+		return o.ServerAddress, true
+	}
+	if customAddress, ok := os.LookupEnv(CustomHostVariable); ok {
+		return customAddress, true
+	}
+	return DefaultServerAddress, false
+}
+
+// rewriteLocation swaps the fake server address at the start of a Location
+// header for the domain the client called. Relative locations and ones
+// pointing elsewhere are left alone, as is everything when the event has no
+// domain name.
+func (ar *AdapterRequest) rewriteLocation(h http.Header) {
+	domainName := ar.DomainName()
+	location := h.Get("Location")
+	if domainName == "" || location == "" {
+		return
+	}
+	// X-Forwarded-Proto can change the scheme of the request URL, so match
+	// the address with either
+	address, _ := ar.opts().serverAddress()
+	if strings.HasPrefix(location, "http://") && strings.HasPrefix(address, "https://") {
+		address = "http://" + strings.TrimPrefix(address, "https://")
+	}
+	if location != address && !strings.HasPrefix(location, address+"/") && !strings.HasPrefix(location, address+"?") {
+		return
+	}
+	h.Set("Location", "https://"+domainName+location[len(address):])
+}
+
+// errHandlerTimeout is returned by serveHTTP when the handler runs past its
+// timeout, or its request is cancelled
+var errHandlerTimeout = errors.New("Handler timed out")
+
+// errInvocationDeadline is returned by serveHTTP when the handler is still
+// running within the deadline margin of the invocation deadline
+var errInvocationDeadline = errors.New("Handler ran into the invocation deadline")
+
+// defaultDeadlineMargin is how long before the invocation deadline Proxy gives
+// up on the handler when the DeadlineMargin option isn't set
+const defaultDeadlineMargin = 100 * time.Millisecond
+
+// defaultMaxDecompressedSize is how far DecompressRequests unpacks a body when
+// the MaxDecompressedSize option isn't set
+const defaultMaxDecompressedSize = 32 << 20
+
+// errHandlerHijacked is returned by serveHTTP when the handler tried to hijack
+// the connection, whatever it wrote after failing is of no use
+var errHandlerHijacked = errors.New("Handler tried to hijack the connection")
 
+// handlerPanic is returned by serveHTTP when it recovered a panic from the
+// handler
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *handlerPanic) Error() string {
+	return fmt.Sprintf("Handler panicked: %v", p.value)
+}
+
+// recoverHandler stores any panic from the handler in p instead of letting it
+// take down the invocation
+func recoverHandler(h http.Handler, p **handlerPanic) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				*p = &handlerPanic{value: v, stack: debug.Stack()}
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP runs the handler against a fresh recorder and returns its
+// response, reporting whether the handler left the Content-Type to be sniffed.
+// A panic is recovered right around the handler, on whichever
+// goroutine runs it, and returned as a *handlerPanic. With recoverPanics false
+// it's raised again here instead, on the caller's goroutine, so it can't take
+// down the process from one serveHTTP started.
+//
+// Given a timeout, or a context that can be cancelled like the one carrying
+// the Lambda deadline, the handler runs on its own goroutine and is abandoned
+// once the request context is done, returning errHandlerTimeout. A context
+// deadline is brought forward by margin, leaving time to send the 504 before
+// Lambda stops the invocation, and reaching it returns errInvocationDeadline.
+// The abandoned handler keeps writing to a recorder nobody reads, so nothing
+// it writes late can end up in a response.
+func serveHTTP(handler http.Handler, r *http.Request, timeout, margin time.Duration, recoverPanics bool) (*http.Response, bool, error) {
+	var recovered *handlerPanic
 	ch := make(chan struct{})
-	wh := requestDoneHandler(handler, ch) // Wrap the handler with our done notifier
+	wh := requestDoneHandler(recoverHandler(handler, &recovered), ch) // Wrap the handler with our done notifier
 	w := httptest.NewRecorder()
-	wh.ServeHTTP(http.ResponseWriter(w), httpRequest)
-	<-ch      // Wait for the request to finish completely
+	rw := &responseWriter{ResponseWriter: w}
+
+	timeoutErr := errHandlerTimeout
+	if deadline, ok := r.Context().Deadline(); ok {
+		if cutoff := deadline.Add(-margin); timeout <= 0 || time.Until(cutoff) < timeout {
+			ctx, cancel := context.WithDeadline(r.Context(), cutoff)
+			defer cancel()
+			r = r.WithContext(ctx)
+			timeoutErr = errInvocationDeadline
+			timeout = 0
+		}
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if ctx := r.Context(); ctx.Done() != nil {
+		go wh.ServeHTTP(rw, r)
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			// select picks at random when both are ready, a handler that
+			// finished right at the cut-off still gets its response out
+			select {
+			case <-ch:
+			default:
+				return nil, false, timeoutErr
+			}
+		}
+	} else {
+		wh.ServeHTTP(rw, r)
+		<-ch // Wait for the request to finish completely
+	}
+
+	// Closing ch happens after the recovery and any Hijack call, so reading
+	// them here is safe
+	if recovered != nil {
+		if !recoverPanics {
+			panic(recovered.value)
+		}
+		return nil, false, recovered
+	}
+	if rw.hijacked {
+		return nil, false, errHandlerHijacked
+	}
+
 	w.Flush() // Not positive this is necessary, but it's got a Flush() so I'll use a Flush().
 	resp := w.Result()
+	resp.Request = r
+	return resp, rw.sniff, nil
+}
 
-	aresp, err := NewAdapterResponse(resp)
-	if err != nil {
-		return nil, errors.Wrap(err, "Unable to convert http.Response into AdapterResponse")
+// errorBody is the JSON body of the responses the adapter returns itself
+type errorBody struct {
+	Message string `json:"message"`
+}
+
+// errorResponse builds a JSON error response with any extra headers, the
+// correlation id and CORS headers, the same options apply to it as to a
+// response from the handler
+func (ar *AdapterRequest) errorResponse(statusCode int, message, correlationID string, header http.Header) (*AdapterResponse, error) {
+	w := httptest.NewRecorder()
+	for h, l := range header {
+		w.Header()[h] = l
+	}
+	if correlationID != "" {
+		w.Header().Set(ar.opts().CorrelationHeader, correlationID)
+	}
+	ar.corsHeaders(w.Header())
+	w.Header().Set(contentTypeHeaderKey, "application/json")
+	w.WriteHeader(statusCode)
+	var body interface{} = errorBody{Message: message}
+	if envelope := ar.opts().ErrorEnvelope; envelope != nil {
+		body = ar.errorEnvelope(envelope, statusCode, message)
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		return nil, errors.Wrap(err, "Unable to encode error response")
 	}
 
+	aresp, err := newAdapterResponse(w.Result(), false, ar.opts())
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to convert error response into AdapterResponse")
+	}
 	return aresp, nil
 }
 
+// errorEnvelope fills in the ErrorEnvelope template. A value that's exactly
+// "{code}" becomes the status code as a number, otherwise "{code}",
+// "{message}" and "{requestId}" are replaced inside the string.
+func (ar *AdapterRequest) errorEnvelope(envelope map[string]string, statusCode int, message string) map[string]interface{} {
+	code := strconv.Itoa(statusCode)
+	r := strings.NewReplacer(
+		"{code}", code,
+		"{message}", message,
+		"{requestId}", ar.requestContextString("requestId"),
+	)
+	body := make(map[string]interface{}, len(envelope))
+	for field, value := range envelope {
+		if value == "{code}" {
+			body[field] = statusCode
+			continue
+		}
+		body[field] = r.Replace(value)
+	}
+	return body
+}
+
 // ToRequest converts the AdapterRequest object into an http.Request that can
-// be fed into the framework's http.ServeHTTP method
+// be fed into the framework's http.ServeHTTP method. It leaves the
+// AdapterRequest untouched, so calling it (or Proxy) again, e.g. on a retry,
+// builds the same request.
 func (ar *AdapterRequest) ToRequest() (*http.Request, error) {
-	decodedBody := []byte(ar.Body)
-	if ar.IsBase64Encoded {
-		base64Body, err := base64.StdEncoding.DecodeString(ar.Body)
-		if err != nil {
-			return nil, err
+	method := ar.HTTPMethod
+	if method == "" {
+		method = ar.requestContextString("http", "method")
+	}
+	method = strings.ToUpper(method)
+	for _, m := range unsupportedMethods {
+		if method == m {
+			return nil, errors.Wrapf(ErrUnsupportedMethod, "Rejected %s request", method)
 		}
-		decodedBody = base64Body
 	}
 
+	opts := ar.opts()
 	path := ar.Path
-	if ar.stripBasePath != "" && len(ar.stripBasePath) > 1 {
+	if path == "" {
+		path = ar.RawPath
+	}
+	if path == "" {
+		path = ar.ContextPath()
+	}
+	if opts.RejectEmptyPath && path == "" {
+		return nil, ErrEmptyPath
+	}
+
+	body, contentLength, gunzip, err := ar.body(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fragments are client side only, a malformed event might still carry one
+	if i := strings.Index(path, "#"); i >= 0 {
+		path = path[:i]
+	}
+	if ar.stripBasePath != "" && len(ar.stripBasePath) > 1 && !opts.basePathExempt(path) {
 		if strings.HasPrefix(path, ar.stripBasePath) {
 			path = strings.Replace(path, ar.stripBasePath, "", 1)
 		}
@@ -119,53 +514,339 @@ func (ar *AdapterRequest) ToRequest() (*http.Request, error) {
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
 	}
-	serverAddress := DefaultServerAddress
-	if customAddress, ok := os.LookupEnv(CustomHostVariable); ok {
-		serverAddress = customAddress
-	}
-	path = serverAddress + path
+	address, configured := opts.serverAddress()
+	path = address + path
 
-	if len(ar.MultiValueQueryStringParameters) > 0 {
+	if ar.RawQueryString != "" {
+		if queryString := opts.stripRawQuery(ar.RawQueryString); queryString != "" {
+			path += "?" + queryString
+		}
+	} else if len(ar.MultiValueQueryStringParameters) > 0 {
+		// Map order is random, sort the names so the same event always gives
+		// the same query string. Values keep the order they arrived in.
+		names := make([]string, 0, len(ar.MultiValueQueryStringParameters))
+		for q := range ar.MultiValueQueryStringParameters {
+			names = append(names, q)
+		}
+		sort.Strings(names)
 		queryString := ""
-		for q, l := range ar.MultiValueQueryStringParameters {
+		for _, q := range names {
+			l := ar.MultiValueQueryStringParameters[q]
+			if opts.stripQueryParameter(q) {
+				continue
+			}
+			if opts.JoinQueryValues != "" {
+				l = []string{strings.Join(l, opts.JoinQueryValues)}
+			}
 			for _, v := range l {
 				if queryString != "" {
 					queryString += "&"
 				}
-				queryString += url.QueryEscape(q) + "=" + url.QueryEscape(v)
+				queryString += opts.escapeQuery(q) + "=" + opts.escapeQuery(v)
 			}
 		}
-		ar.Path += "?" + queryString
+		if queryString != "" {
+			path += "?" + queryString
+		}
 	} else if len(ar.QueryStringParameters) > 0 {
 		// Support `QueryStringParameters` for backward compatibility.
 		// https://github.com/awslabs/aws-lambda-go-api-proxy/issues/37
-		queryString := ""
+		names := make([]string, 0, len(ar.QueryStringParameters))
 		for q := range ar.QueryStringParameters {
+			names = append(names, q)
+		}
+		sort.Strings(names)
+		queryString := ""
+		for _, q := range names {
+			if opts.stripQueryParameter(q) {
+				continue
+			}
 			if queryString != "" {
 				queryString += "&"
 			}
-			queryString += url.QueryEscape(q) + "=" + url.QueryEscape(ar.QueryStringParameters[q])
+			queryString += opts.escapeQuery(q) + "=" + opts.escapeQuery(ar.QueryStringParameters[q])
+		}
+		if queryString != "" {
+			path += "?" + queryString
 		}
-		ar.Path += "?" + queryString
 	}
 
 	httpRequest, err := http.NewRequest(
-		strings.ToUpper(ar.HTTPMethod),
-		ar.Path,
-		bytes.NewReader(decodedBody),
+		method,
+		path,
+		body,
 	)
 	if err != nil {
-		fmt.Printf("Could not convert request %s:%s to http.Request\n", ar.HTTPMethod, ar.Path)
+		fmt.Printf("Could not convert request %s:%s to http.Request\n", ar.HTTPMethod, path)
 		log.Println(err)
 		return nil, err
 	}
+	// http.NewRequest can't work out the length of a streamed body
+	httpRequest.ContentLength = contentLength
+	// An ALB forwards plain http too and says so in X-Forwarded-Proto, API
+	// Gateway only takes https. The protocol in the request context is the
+	// HTTP version, not the scheme, so it's no help here.
+	if proto, ok := ar.header("X-Forwarded-Proto"); ok {
+		proto = strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+		if proto == "http" || proto == "https" {
+			httpRequest.URL.Scheme = proto
+		}
+	}
+	if httpRequest.URL.Scheme == "https" {
+		// There's no handshake to describe, a non-nil TLS is what handlers
+		// and middleware check for
+		httpRequest.TLS = &tls.ConnectionState{}
+	}
+	if ip := ar.clientIP(); ip != "" {
+		// Port 0 keeps net.SplitHostPort happy
+		httpRequest.RemoteAddr = net.JoinHostPort(ip, "0")
+	}
 
+	// Values are copied byte for byte, signature schemes checking
+	// Authorization care about every space. API Gateway repeats headers in
+	// both maps with only the last value in Headers, so MultiValueHeaders wins
+	// for any header found in both.
+	for h, l := range ar.MultiValueHeaders {
+		for _, v := range l {
+			httpRequest.Header.Add(h, v)
+		}
+	}
 	for h := range ar.Headers {
+		if _, ok := httpRequest.Header[http.CanonicalHeaderKey(h)]; ok && ar.hasMultiValueHeader(h) {
+			continue
+		}
 		httpRequest.Header.Add(h, ar.Headers[h])
 	}
+	if len(ar.Cookies) > 0 {
+		// v2 events move the Cookie header into its own array
+		httpRequest.Header.Add("Cookie", strings.Join(ar.Cookies, "; "))
+	}
+	for _, h := range strippedRequestHeaders {
+		httpRequest.Header.Del(h)
+	}
+	if gunzip {
+		// The handler gets the body decompressed, don't let middleware try
+		// again
+		httpRequest.Header.Del("Content-Encoding")
+		httpRequest.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+
+	// Always replace the context headers, a client sending its own mustn't be
+	// able to pass them off as coming from API Gateway
+	httpRequest.Header.Del(APIGwContextHeader)
+	if ar.RequestContext != nil {
+		requestContext, err := json.Marshal(ar.RequestContext)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to marshal request context")
+		}
+		httpRequest.Header.Set(APIGwContextHeader, string(requestContext))
+	}
+
+	stageVars := ar.StageVariables
+	if stageVars == nil {
+		stageVars = map[string]string{}
+	}
+	stageVarsJSON, err := json.Marshal(stageVars)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to marshal stage variables")
+	}
+	httpRequest.Header.Set(APIGwStageVarsHeader, string(stageVarsJSON))
+	if opts.DefaultUserAgent != "" && httpRequest.Header.Get("User-Agent") == "" {
+		httpRequest.Header.Set("User-Agent", opts.DefaultUserAgent)
+	}
+	// http.NewRequest took the host from the server address. Unless one was
+	// configured, use the host the client called so virtual host routing and
+	// links built from r.Host work.
+	if !configured {
+		if host := httpRequest.Header.Get("X-Forwarded-Host"); host != "" && opts.TrustForwardedHost {
+			httpRequest.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+		} else if host := httpRequest.Header.Get("Host"); host != "" {
+			httpRequest.Host = host
+		}
+	}
+	httpRequest.Header.Set("Host", httpRequest.Host)
+	if opts.ForwardedFor && httpRequest.Header.Get("X-Forwarded-For") == "" {
+		if ip := ar.clientIP(); ip != "" {
+			httpRequest.Header.Set("X-Forwarded-For", ip)
+		}
+	}
 	return httpRequest, nil
 }
 
+// body returns the request body the handler reads and its length, base64
+// decoded and, with DecompressRequests, gunzipped. It reports whether the body
+// was gunzipped so ToRequest can fix up the headers.
+func (ar *AdapterRequest) body(opts *AdapterOptions) (io.Reader, int64, bool, error) {
+	var body io.Reader = strings.NewReader(ar.Body)
+	contentLength := int64(len(ar.Body))
+	// A null body unmarshals to "", which is an empty body whatever the
+	// base64 flag says
+	if ar.IsBase64Encoded && ar.Body != "" {
+		if opts.StreamBodyThreshold > 0 && len(ar.Body) > opts.StreamBodyThreshold {
+			// Decode as the handler reads instead of holding both copies of a
+			// large body in memory at once
+			body = &base64BodyReader{base64.NewDecoder(base64.StdEncoding, strings.NewReader(ar.Body))}
+			contentLength = int64(base64DecodedLen(ar.Body))
+		} else {
+			base64Body, err := base64.StdEncoding.DecodeString(ar.Body)
+			if err != nil {
+				return nil, 0, false, errors.Wrap(ErrInvalidBase64Body, err.Error())
+			}
+			body = bytes.NewReader(base64Body)
+			contentLength = int64(len(base64Body))
+		}
+	}
+
+	ce, ok := ar.header("Content-Encoding")
+	if !ok || !opts.DecompressRequests || ar.Body == "" || !strings.EqualFold(strings.TrimSpace(ce), "gzip") {
+		return body, contentLength, false, nil
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, 0, false, errors.Wrap(ErrInvalidGzipBody, err.Error())
+	}
+	// Read one byte past the cap to tell a body that fits exactly from one
+	// that doesn't
+	max := opts.maxDecompressedSize()
+	decompressedBody, err := ioutil.ReadAll(io.LimitReader(zr, max+1))
+	if err != nil {
+		return nil, 0, false, errors.Wrap(ErrInvalidGzipBody, err.Error())
+	}
+	if int64(len(decompressedBody)) > max {
+		return nil, 0, false, errors.Wrapf(ErrInvalidGzipBody, "Body decompresses to more than %d bytes", max)
+	}
+	return bytes.NewReader(decompressedBody), int64(len(decompressedBody)), true, nil
+}
+
+// clientIP returns the client IP API Gateway recorded, v2 and Function URL
+// events have it in http.sourceIp and REST API events in identity.sourceIp
+func (ar *AdapterRequest) clientIP() string {
+	if ip := ar.requestContextString("http", "sourceIp"); ip != "" {
+		return ip
+	}
+	return ar.SourceIP()
+}
+
+// header returns the first value of the named request header, looking in both
+// header maps with MultiValueHeaders winning like it does in ToRequest. Events
+// don't canonicalize header names so compare them case insensitively.
+func (ar *AdapterRequest) header(name string) (string, bool) {
+	for h, l := range ar.MultiValueHeaders {
+		if strings.EqualFold(h, name) && len(l) > 0 {
+			return l[0], true
+		}
+	}
+	for h, v := range ar.Headers {
+		if strings.EqualFold(h, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Query returns the decoded query parameters of the request, the same set the
+// handler sees, so middleware doesn't have to parse the URL
+func (ar *AdapterRequest) Query() url.Values {
+	opts := ar.opts()
+
+	query := url.Values{}
+	if ar.RawQueryString != "" {
+		// ParseQuery hands back whatever it could parse along with the error
+		query, _ = url.ParseQuery(opts.stripRawQuery(ar.RawQueryString))
+	} else if len(ar.MultiValueQueryStringParameters) > 0 {
+		for q, l := range ar.MultiValueQueryStringParameters {
+			if opts.stripQueryParameter(q) {
+				continue
+			}
+			if opts.JoinQueryValues != "" {
+				l = []string{strings.Join(l, opts.JoinQueryValues)}
+			}
+			for _, v := range l {
+				query.Add(opts.unescapeQuery(q), opts.unescapeQuery(v))
+			}
+		}
+	} else {
+		for q, v := range ar.QueryStringParameters {
+			if opts.stripQueryParameter(q) {
+				continue
+			}
+			query.Add(opts.unescapeQuery(q), opts.unescapeQuery(v))
+		}
+	}
+	return query
+}
+
+// StageVar returns the named stage variable, or def when the stage doesn't set
+// it
+func (ar *AdapterRequest) StageVar(name, def string) string {
+	if v, ok := ar.StageVariables[name]; ok {
+		return v
+	}
+	return def
+}
+
+// PathParam returns the named path parameter URL decoded, API Gateway hands
+// them over still encoded. A value that doesn't decode comes back as is.
+func (ar *AdapterRequest) PathParam(name string) string {
+	v := ar.PathParameters[name]
+	if decoded, err := url.PathUnescape(v); err == nil {
+		return decoded
+	}
+	return v
+}
+
+// hasMultiValueHeader reports whether the header is in MultiValueHeaders
+func (ar *AdapterRequest) hasMultiValueHeader(name string) bool {
+	for h := range ar.MultiValueHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodedBodyLength returns the length of the body as it arrived in the event,
+// before any base64 decoding
+func (ar *AdapterRequest) EncodedBodyLength() int {
+	return len(ar.Body)
+}
+
+// DecodedBodyLength returns the length of the body the handler will see, the
+// request's ContentLength. It goes through the same base64 decoding and
+// DecompressRequests gunzipping as ToRequest. A body above the
+// StreamBodyThreshold isn't decoded, its length comes from the base64 padding
+// so invalid base64 only shows up once the handler reads it.
+func (ar *AdapterRequest) DecodedBodyLength() (int, error) {
+	_, contentLength, _, err := ar.body(ar.opts())
+	if err != nil {
+		return 0, err
+	}
+	return int(contentLength), nil
+}
+
+// base64BodyReader reads a streamed base64 body, turning decode errors into
+// ErrInvalidBase64Body so the handler can't mistake a truncated body for a
+// short one
+type base64BodyReader struct {
+	r io.Reader
+}
+
+// Read implements io.Reader
+func (b *base64BodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = errors.Wrap(ErrInvalidBase64Body, err.Error())
+	}
+	return n, err
+}
+
+// base64DecodedLen returns the decoded length of padded base64 without
+// decoding it
+func base64DecodedLen(s string) int {
+	n := base64.StdEncoding.DecodedLen(len(s))
+	return n - (len(s) - len(strings.TrimRight(s, "=")))
+}
+
 // StripBasePath used to satisfy base path mappings in API Gateway
 func (ar *AdapterRequest) StripBasePath(basePath string) string {
 	if strings.Trim(basePath, " ") == "" {
@@ -188,7 +869,11 @@ func (ar *AdapterRequest) StripBasePath(basePath string) string {
 }
 
 // AdapterResponse is a struct that contains fields required to produce either
-// an events.APIGatewayResponse or events.ALBTargetGroupResponse
+// an events.APIGatewayResponse or events.ALBTargetGroupResponse. Headers holds
+// the first value of each response header and MultiValueHeaders all of them.
+// API Gateway merges the two and drops pairs repeated in both, an ALB only
+// reads the map matching its multi value headers setting. If the two are
+// edited into disagreeing, the event responses go with MultiValueHeaders.
 type AdapterResponse struct {
 	StatusCode        int                 `json:"statusCode"`
 	StatusDescription string              `json:"statusDescription"`
@@ -196,50 +881,375 @@ type AdapterResponse struct {
 	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
 	Body              string              `json:"body"`
 	IsBase64Encoded   bool                `json:"isBase64Encoded,omitempty"`
+	rawBody           []byte
 }
 
 // NewAdapterResponse converts an http.Response into an AdapterResponse
 func NewAdapterResponse(r *http.Response) (*AdapterResponse, error) {
+	return newAdapterResponse(r, false, &AdapterOptions{})
+}
+
+// newAdapterResponse is NewAdapterResponse honoring the request's options.
+// sniff says the response came through responseWriter without a Content-Type,
+// so one is picked here.
+func newAdapterResponse(r *http.Response, sniff bool, opts *AdapterOptions) (*AdapterResponse, error) {
 	defer r.Body.Close()
 	rb, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return nil, errors.Wrap(err, "Unable to read response body")
 	}
 
+	statusCode := r.StatusCode
+	if opts.MapStatus != nil {
+		statusCode = opts.MapStatus(statusCode)
+	}
+
+	if statusCode == http.StatusNoContent && len(rb) > 0 {
+		if opts.StrictNoContent {
+			return nil, errors.Wrapf(ErrBodyNotAllowed, "Handler wrote %d bytes with a 204", len(rb))
+		}
+		rb = nil
+	}
+
+	if len(rb) == 0 {
+		if body, ok := opts.EmptyBodyDefaults[statusCode]; ok {
+			rb = []byte(body)
+		}
+	}
+
+	// A handler can set an empty Content-Type itself to turn sniffing off,
+	// the same as with net/http, then we leave the type alone
+	_, disabled := r.Header[contentTypeHeaderKey]
+	if len(r.Header.Values(contentTypeHeaderKey)) == 0 && (sniff || !disabled) {
+		// responseWriter held back the recorder's sniffing, do it here instead
+		// unless the body is JSON we're asked to spot
+		r.Header.Del(contentTypeHeaderKey)
+		switch {
+		case len(rb) == 0:
+		case opts.DetectJSON && json.Valid(rb):
+			r.Header.Set(contentTypeHeaderKey, "application/json")
+		case sniff && !opts.DisableSniffing:
+			r.Header.Set(contentTypeHeaderKey, http.DetectContentType(rb))
+		}
+	}
+
+	if opts.TransformBody != nil {
+		rb = opts.TransformBody(r.Header.Get(contentTypeHeaderKey), rb)
+	}
+
+	// Dropping a 204 body, EmptyBodyDefaults and TransformBody can all change
+	// the body, keep any Content-Length the handler set in step with it
+	if r.Header.Get("Content-Length") != "" {
+		if statusCode == http.StatusNoContent {
+			r.Header.Del("Content-Length")
+		} else {
+			r.Header.Set("Content-Length", strconv.Itoa(len(rb)))
+		}
+	}
+
+	if opts.AutoETag && setETag(r, statusCode, rb, opts.WeakETag) {
+		statusCode = http.StatusNotModified
+		rb = nil
+		r.Header.Del(contentTypeHeaderKey)
+		r.Header.Del("Content-Length")
+	}
+
+	if opts.EnsureCharset && utf8.Valid(rb) {
+		if ct, ok := withUTF8Charset(r.Header.Get(contentTypeHeaderKey)); ok {
+			r.Header.Set(contentTypeHeaderKey, ct)
+		}
+	}
+
+	body, compressed, err := gzipBody(r, statusCode, rb, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to gzip response body")
+	}
+
+	removeHopByHopHeaders(r.Header)
+	for h, l := range opts.ResponseHeaders {
+		h = http.CanonicalHeaderKey(h)
+		if _, ok := r.Header[h]; !ok {
+			r.Header[h] = append([]string(nil), l...)
+		}
+	}
+	singleValueHeaders := opts.SingleValueHeaders
+	if singleValueHeaders == nil {
+		singleValueHeaders = defaultSingleValueHeaders
+	}
+	for _, h := range singleValueHeaders {
+		if v := r.Header.Values(h); len(v) > 1 {
+			r.Header.Set(h, v[0])
+		}
+	}
+	if opts.MaxResponseHeaderCount > 0 {
+		count := 0
+		for _, l := range r.Header {
+			count += len(l)
+		}
+		if count > opts.MaxResponseHeaderCount {
+			return nil, errors.Wrapf(ErrTooManyHeaders, "Handler set %d headers, the limit is %d", count, opts.MaxResponseHeaderCount)
+		}
+	}
+
 	var output string
 	isBase64 := false
 
-	if utf8.Valid(rb) {
-		output = string(rb)
+	if !compressed && !needsBase64(r.Header.Get(contentTypeHeaderKey), body, opts) {
+		output = string(body)
 	} else {
-		output = base64.StdEncoding.EncodeToString(rb)
+		output = base64.StdEncoding.EncodeToString(body)
 		isBase64 = true
 	}
+	if opts.MaxResponseSize > 0 && len(output) > opts.MaxResponseSize {
+		return nil, errors.Wrapf(ErrResponseTooLarge, "Response body is %d bytes as sent, the limit is %d", len(output), opts.MaxResponseSize)
+	}
+
+	headers := map[string]string{}
+	for h, l := range r.Header {
+		if len(l) > 0 {
+			headers[h] = l[0]
+		}
+	}
 
 	return &AdapterResponse{
-		StatusCode:        r.StatusCode,
+		StatusCode:        statusCode,
 		StatusDescription: "", // Why?
-		Headers:           map[string]string{},
+		Headers:           headers,
 		MultiValueHeaders: r.Header,
 		Body:              output,
 		IsBase64Encoded:   isBase64,
+		rawBody:           rb,
 	}, nil
 }
 
+// hasMultiValueHeader reports whether the header is in MultiValueHeaders,
+// which wins over Headers when both have it
+func (ar *AdapterResponse) hasMultiValueHeader(name string) bool {
+	for h := range ar.MultiValueHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalStable returns the response as indented JSON with every key sorted,
+// struct fields included, so snapshot tests get byte identical output
+func (ar *AdapterResponse) MarshalStable() ([]byte, error) {
+	b, err := json.Marshal(ar)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to marshal AdapterResponse")
+	}
+	// Going through a generic map gets the struct fields sorted too, json
+	// always writes map keys in order
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, errors.Wrap(err, "Unable to unmarshal AdapterResponse")
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// RawBody returns the response body before any gzip or base64 encoding, as
+// the handler wrote it unless the TransformBody option changed it. Handy for
+// golden tests.
+func (ar *AdapterResponse) RawBody() []byte {
+	return ar.rawBody
+}
+
+// removeHopByHopHeaders drops the hop-by-hop headers, including any the
+// Connection header names
+func removeHopByHopHeaders(h http.Header) {
+	for _, c := range h.Values("Connection") {
+		for _, name := range strings.Split(c, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// isBinaryContentType reports whether the content type is one of
+// binaryTypes, which must be base64 encoded regardless of the body contents.
+// Entries ending in / are matched as a prefix, except by +xml and +json
+// subtypes like image/svg+xml, which are text. Those only match exactly.
+func isBinaryContentType(contentType string, binaryTypes []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	structuredText := strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "+json")
+	for _, t := range binaryTypes {
+		if mediaType == t {
+			return true
+		}
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) && !structuredText {
+			return true
+		}
+	}
+	return false
+}
+
+// withUTF8Charset adds charset=utf-8 to a text/* content type that doesn't
+// have a charset, reporting whether it changed anything
+func withUTF8Charset(contentType string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "text/") {
+		return contentType, false
+	}
+	if _, ok := params["charset"]; ok {
+		return contentType, false
+	}
+	params["charset"] = "utf-8"
+	return mime.FormatMediaType(mediaType, params), true
+}
+
+// isTextContentType reports whether the content type is known to be text
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json",
+		"application/xml",
+		"application/javascript",
+		"application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// needsBase64 decides whether a response body has to be base64 encoded.
+// Binary content types always are, and we don't know which binary media types
+// API Gateway is configured with, so by default anything that isn't a known
+// text type is encoded even when it's valid utf8. LenientBase64 falls back to
+// only checking the body, bodies without a content type are always checked
+// that way.
+func needsBase64(contentType string, body []byte, opts *AdapterOptions) bool {
+	binaryTypes := opts.BinaryContentTypes
+	if binaryTypes == nil {
+		binaryTypes = defaultBinaryContentTypes
+	}
+	if isBinaryContentType(contentType, binaryTypes) || !utf8.Valid(body) {
+		return true
+	}
+	if opts.LenientBase64 || contentType == "" {
+		return false
+	}
+	return !isTextContentType(contentType)
+}
+
 // APIGatewayProxyResponse returns an events.APIGatewayProxyResponse from the
 // AdapterResponse
 func (ar *AdapterResponse) APIGatewayProxyResponse() (events.APIGatewayProxyResponse, error) {
 	return events.APIGatewayProxyResponse{
 		StatusCode:        ar.StatusCode,
-		Headers:           map[string]string{},
+		Headers:           ar.singleValueHeaders(),
 		MultiValueHeaders: ar.MultiValueHeaders,
 		Body:              ar.Body,
 		IsBase64Encoded:   ar.IsBase64Encoded,
 	}, nil
 }
 
+// singleValueHeaders returns a copy of Headers agreeing with
+// MultiValueHeaders. newAdapterResponse keeps the two in step, but either can
+// be edited afterwards and API Gateway would then send both values. When a
+// header is in both maps the multi value side wins, its first value replaces
+// the single one.
+func (ar *AdapterResponse) singleValueHeaders() map[string]string {
+	if ar.Headers == nil {
+		return nil
+	}
+	headers := make(map[string]string, len(ar.Headers))
+	for h, v := range ar.Headers {
+		headers[h] = v
+	}
+	for h, l := range ar.MultiValueHeaders {
+		for single := range headers {
+			if strings.EqualFold(single, h) {
+				delete(headers, single)
+			}
+		}
+		if len(l) > 0 {
+			headers[h] = l[0]
+		}
+	}
+	return headers
+}
+
+// APIGatewayV2HTTPResponse returns an events.APIGatewayV2HTTPResponse from
+// the AdapterResponse, for HTTP API payload format 2.0 events. Payload 2.0
+// returns cookies in their own array rather than as Set-Cookie headers, and
+// has no multi value headers so repeated headers are comma separated.
+func (ar *AdapterResponse) APIGatewayV2HTTPResponse() (events.APIGatewayV2HTTPResponse, error) {
+	headers, multiValueHeaders, cookies := ar.splitCookies()
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode:        ar.StatusCode,
+		Headers:           headers,
+		MultiValueHeaders: multiValueHeaders,
+		Body:              ar.Body,
+		IsBase64Encoded:   ar.IsBase64Encoded,
+		Cookies:           cookies,
+	}, nil
+}
+
+// splitCookies returns copies of the response headers without Set-Cookie,
+// the single value headers comma joining repeated values, along with the
+// Set-Cookie values
+func (ar *AdapterResponse) splitCookies() (map[string]string, map[string][]string, []string) {
+	var cookies []string
+	headers := map[string]string{}
+	multiValueHeaders := map[string][]string{}
+	for h, l := range ar.MultiValueHeaders {
+		if http.CanonicalHeaderKey(h) == "Set-Cookie" {
+			cookies = append(cookies, l...)
+			continue
+		}
+		multiValueHeaders[h] = l
+		headers[h] = strings.Join(l, ",")
+	}
+	for h, v := range ar.Headers {
+		if !ar.hasMultiValueHeader(h) && http.CanonicalHeaderKey(h) != "Set-Cookie" {
+			headers[h] = v
+		}
+	}
+	return headers, multiValueHeaders, cookies
+}
+
+// LambdaFunctionURLResponse returns an events.LambdaFunctionURLResponse from
+// the AdapterResponse. Function URLs use the payload 2.0 shape, cookies are
+// returned in their own array and repeated headers are comma separated.
+func (ar *AdapterResponse) LambdaFunctionURLResponse() (events.LambdaFunctionURLResponse, error) {
+	headers, _, cookies := ar.splitCookies()
+	return events.LambdaFunctionURLResponse{
+		StatusCode:      ar.StatusCode,
+		Headers:         headers,
+		Body:            ar.Body,
+		IsBase64Encoded: ar.IsBase64Encoded,
+		Cookies:         cookies,
+	}, nil
+}
+
 // ALBTargetGroupResponse returns an events.ALBTargetGroupResponse from the
 // AdapterResponse
 func (ar *AdapterResponse) ALBTargetGroupResponse() (events.ALBTargetGroupResponse, error) {
-	return events.ALBTargetGroupResponse(*ar), nil
+	return events.ALBTargetGroupResponse{
+		StatusCode:        ar.StatusCode,
+		StatusDescription: ar.StatusDescription,
+		Headers:           ar.singleValueHeaders(),
+		MultiValueHeaders: ar.MultiValueHeaders,
+		Body:              ar.Body,
+		IsBase64Encoded:   ar.IsBase64Encoded,
+	}, nil
 }
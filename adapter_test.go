@@ -0,0 +1,1544 @@
+package awseventadapter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// serve proxies the event through the handler, failing the test on an error
+func serve(t *testing.T, ar *AdapterRequest, h http.HandlerFunc) *AdapterResponse {
+	t.Helper()
+	resp, err := ar.Proxy(context.Background(), h)
+	if err != nil {
+		t.Fatalf("Proxy: %v", err)
+	}
+	return resp
+}
+
+// handlerRequest proxies the event and returns the request the handler got
+func handlerRequest(t *testing.T, ar *AdapterRequest) *http.Request {
+	t.Helper()
+	var got *http.Request
+	serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	})
+	if got == nil {
+		t.Fatal("Handler wasn't called")
+	}
+	return got
+}
+
+// respond returns a handler writing body with the content type
+func respond(contentType, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Write([]byte(body))
+	}
+}
+
+func TestTextLikePDFIsBase64Encoded(t *testing.T) {
+	const pdf = "%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\n%%EOF"
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/report.pdf"}
+	resp := serve(t, ar, respond("application/pdf", pdf))
+
+	if !resp.IsBase64Encoded {
+		t.Fatal("utf8 valid application/pdf body wasn't base64 encoded")
+	}
+	if want := base64.StdEncoding.EncodeToString([]byte(pdf)); resp.Body != want {
+		t.Errorf("Body = %q, want %q", resp.Body, want)
+	}
+}
+
+func TestStripQueryParameters(t *testing.T) {
+	opts := &AdapterOptions{StripQueryParameters: []string{"utm_source"}}
+	for name, ar := range map[string]*AdapterRequest{
+		"multi value":  {MultiValueQueryStringParameters: map[string][]string{"q": {"go"}, "utm_source": {"mail"}}},
+		"single value": {QueryStringParameters: map[string]string{"q": "go", "utm_source": "mail"}},
+		"raw":          {RawQueryString: "q=go&utm_source=mail"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ar.HTTPMethod = "GET"
+			ar.Path = "/search"
+			ar.SetOptions(opts)
+			query := handlerRequest(t, ar).URL.Query()
+			if _, ok := query["utm_source"]; ok {
+				t.Errorf("Stripped parameter reached the handler: %v", query)
+			}
+			if got := query.Get("q"); got != "go" {
+				t.Errorf("q = %q, want %q", got, "go")
+			}
+			if _, ok := ar.Query()["utm_source"]; ok {
+				t.Errorf("Query() kept the stripped parameter")
+			}
+		})
+	}
+}
+
+// gzipped compresses s for request bodies
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestBodyLengths(t *testing.T) {
+	const body = "hello, world"
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for name, tc := range map[string]struct {
+		ar   *AdapterRequest
+		opts *AdapterOptions
+	}{
+		"base64":   {&AdapterRequest{Body: encoded, IsBase64Encoded: true}, nil},
+		"streamed": {&AdapterRequest{Body: encoded, IsBase64Encoded: true}, &AdapterOptions{StreamBodyThreshold: 1}},
+		"plain":    {&AdapterRequest{Body: body}, nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc.ar.SetOptions(tc.opts)
+			if got, want := tc.ar.EncodedBodyLength(), len(tc.ar.Body); got != want {
+				t.Errorf("EncodedBodyLength() = %d, want %d", got, want)
+			}
+			got, err := tc.ar.DecodedBodyLength()
+			if err != nil || got != len(body) {
+				t.Errorf("DecodedBodyLength() = %d, %v, want %d", got, err, len(body))
+			}
+		})
+	}
+
+	ar := &AdapterRequest{
+		Headers:         map[string]string{"Content-Encoding": "gzip"},
+		Body:            base64.StdEncoding.EncodeToString(gzipped(t, body)),
+		IsBase64Encoded: true,
+	}
+	ar.SetOptions(&AdapterOptions{DecompressRequests: true})
+	if got, err := ar.DecodedBodyLength(); err != nil || got != len(body) {
+		t.Errorf("DecodedBodyLength() of a gzipped body = %d, %v, want %d", got, err, len(body))
+	}
+
+	ar = &AdapterRequest{Body: "not base64!", IsBase64Encoded: true}
+	if _, err := ar.DecodedBodyLength(); errors.Cause(err) != ErrInvalidBase64Body {
+		t.Errorf("DecodedBodyLength() of invalid base64 returned %v, want ErrInvalidBase64Body", err)
+	}
+}
+
+func TestConservativeBase64(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		lenient     bool
+		want        bool
+	}{
+		{"application/octet-stream", false, true},
+		{"application/octet-stream", true, true},
+		{"application/x-custom", false, true},
+		{"application/x-custom", true, false},
+		{"application/json", false, false},
+		{"text/plain", false, false},
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+		ar.SetOptions(&AdapterOptions{LenientBase64: tc.lenient})
+		resp := serve(t, ar, respond(tc.contentType, "plain ascii"))
+		if resp.IsBase64Encoded != tc.want {
+			t.Errorf("%s with LenientBase64 %v: IsBase64Encoded = %v, want %v", tc.contentType, tc.lenient, resp.IsBase64Encoded, tc.want)
+		}
+	}
+}
+
+func TestPreEncodedQuery(t *testing.T) {
+	ar := &AdapterRequest{
+		HTTPMethod:                      "GET",
+		Path:                            "/",
+		MultiValueQueryStringParameters: map[string][]string{"q": {"hello%20world"}},
+	}
+	if got := handlerRequest(t, ar).URL.RawQuery; got != "q=hello%2520world" {
+		t.Errorf("RawQuery = %q, want the value escaped", got)
+	}
+
+	ar.SetOptions(&AdapterOptions{PreEncodedQuery: true})
+	r := handlerRequest(t, ar)
+	if r.URL.RawQuery != "q=hello%20world" {
+		t.Errorf("RawQuery with PreEncodedQuery = %q, want %q", r.URL.RawQuery, "q=hello%20world")
+	}
+	if got := r.URL.Query().Get("q"); got != "hello world" {
+		t.Errorf("q = %q, want %q", got, "hello world")
+	}
+	if got := ar.Query().Get("q"); got != "hello world" {
+		t.Errorf("Query() q = %q, want %q", got, "hello world")
+	}
+}
+
+func TestUnsupportedMethod(t *testing.T) {
+	for _, method := range []string{"CONNECT", "connect"} {
+		ar := &AdapterRequest{HTTPMethod: method, Path: "/"}
+		if _, err := ar.ToRequest(); errors.Cause(err) != ErrUnsupportedMethod {
+			t.Errorf("ToRequest() of %s returned %v, want ErrUnsupportedMethod", method, err)
+		}
+	}
+	ar := &AdapterRequest{HTTPMethod: "OPTIONS", Path: "/"}
+	if _, err := ar.ToRequest(); err != nil {
+		t.Errorf("ToRequest() of OPTIONS: %v", err)
+	}
+}
+
+func TestRecoverPanicUnderTimeout(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/slow"}
+	ar.SetOptions(&AdapterOptions{RouteTimeouts: map[string]time.Duration{"/slow": time.Minute}})
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("Handler isn't running under the timeout")
+		}
+		panic("boom")
+	})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("StatusCode = %d, want 500", resp.StatusCode)
+	}
+}
+
+func TestHeadersAndMultiValueHeadersAgree(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Add("X-Multi", "one")
+		w.Header().Add("X-Multi", "two")
+		w.Write([]byte("{}"))
+	})
+	if len(resp.Headers) != len(resp.MultiValueHeaders) {
+		t.Errorf("Headers %v and MultiValueHeaders %v have different keys", resp.Headers, resp.MultiValueHeaders)
+	}
+	for h, l := range resp.MultiValueHeaders {
+		if resp.Headers[h] != l[0] {
+			t.Errorf("Headers[%q] = %q, want the first value %q", h, resp.Headers[h], l[0])
+		}
+	}
+	if got := resp.MultiValueHeaders["X-Multi"]; len(got) != 2 {
+		t.Errorf("MultiValueHeaders[X-Multi] = %q, want both values", got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ar := &AdapterRequest{
+		MultiValueQueryStringParameters: map[string][]string{"q": {"hello world"}, "tag": {"a&b", "c"}},
+	}
+	query := ar.Query()
+	if got := query.Get("q"); got != "hello world" {
+		t.Errorf("q = %q, want %q", got, "hello world")
+	}
+	if got := query["tag"]; len(got) != 2 || got[0] != "a&b" || got[1] != "c" {
+		t.Errorf("tag = %q, want [a&b c]", got)
+	}
+
+	ar = &AdapterRequest{RawQueryString: "q=hello%20world&name=caf%C3%A9"}
+	query = ar.Query()
+	if got := query.Get("q"); got != "hello world" {
+		t.Errorf("raw q = %q, want %q", got, "hello world")
+	}
+	if got := query.Get("name"); got != "café" {
+		t.Errorf("raw name = %q, want %q", got, "café")
+	}
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	opts := &AdapterOptions{DefaultUserAgent: "internal-caller/1.0"}
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(opts)
+	if got := handlerRequest(t, ar).UserAgent(); got != "internal-caller/1.0" {
+		t.Errorf("User-Agent = %q, want the default", got)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"user-agent": "curl/8.0"}}
+	ar.SetOptions(opts)
+	if got := handlerRequest(t, ar).UserAgent(); got != "curl/8.0" {
+		t.Errorf("User-Agent = %q, want the one from the event", got)
+	}
+}
+
+func TestHopByHopHeadersRemoved(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close, X-Internal")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Internal", "1")
+		w.Header().Set("X-Kept", "1")
+	})
+	for _, h := range []string{"Connection", "Keep-Alive", "X-Internal"} {
+		if _, ok := resp.MultiValueHeaders[h]; ok {
+			t.Errorf("%s wasn't removed from MultiValueHeaders", h)
+		}
+		if _, ok := resp.Headers[h]; ok {
+			t.Errorf("%s wasn't removed from Headers", h)
+		}
+	}
+	if resp.Headers["X-Kept"] != "1" {
+		t.Errorf("X-Kept = %q, want it kept", resp.Headers["X-Kept"])
+	}
+}
+
+// benchmarkBody converts a 1MB base64 body and reads it the way a handler
+// would, with the threshold deciding between buffering and streaming
+func benchmarkBody(b *testing.B, threshold int) {
+	ar := &AdapterRequest{
+		HTTPMethod:      "POST",
+		Path:            "/upload",
+		Body:            base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("x"), 1<<20)),
+		IsBase64Encoded: true,
+	}
+	ar.SetOptions(&AdapterOptions{StreamBodyThreshold: threshold})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := ar.ToRequest()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBodyBuffered(b *testing.B) {
+	benchmarkBody(b, 0)
+}
+
+func BenchmarkBodyStreamed(b *testing.B) {
+	benchmarkBody(b, 1024)
+}
+
+func TestStreamedBodyMatchesBuffered(t *testing.T) {
+	const body = "a body long enough to be streamed"
+	for _, threshold := range []int{0, 8} {
+		ar := &AdapterRequest{
+			HTTPMethod:      "POST",
+			Path:            "/",
+			Body:            base64.StdEncoding.EncodeToString([]byte(body)),
+			IsBase64Encoded: true,
+		}
+		ar.SetOptions(&AdapterOptions{StreamBodyThreshold: threshold})
+		r, err := ar.ToRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r.Body)
+		if err != nil || string(got) != body {
+			t.Errorf("Threshold %d: body = %q, %v, want %q", threshold, got, err, body)
+		}
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("Threshold %d: ContentLength = %d, want %d", threshold, r.ContentLength, len(body))
+		}
+	}
+}
+
+func TestMapStatus(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{MapStatus: func(statusCode int) int {
+		if statusCode == http.StatusTeapot {
+			return http.StatusBadRequest
+		}
+		return statusCode
+	}})
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("StatusCode = %d, want 400", resp.StatusCode)
+	}
+	resp = serve(t, ar, respond("text/plain", "ok"))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode of an unmapped status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestFragmentStripped(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/docs#section", QueryStringParameters: map[string]string{"q": "go"}}
+	r := handlerRequest(t, ar)
+	if r.URL.Path != "/docs" || r.URL.Fragment != "" {
+		t.Errorf("URL = %q, want the fragment stripped", r.URL)
+	}
+	if r.URL.RawQuery != "q=go" {
+		t.Errorf("RawQuery = %q, want %q", r.URL.RawQuery, "q=go")
+	}
+}
+
+func TestRawBody(t *testing.T) {
+	for _, contentType := range []string{"text/plain", "application/octet-stream"} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+		resp := serve(t, ar, respond(contentType, "handler output"))
+		if got := string(resp.RawBody()); got != "handler output" {
+			t.Errorf("%s: RawBody() = %q, want the handler output", contentType, got)
+		}
+	}
+}
+
+func TestEmptyBodyDefaults(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{EmptyBodyDefaults: map[int]string{http.StatusOK: "{}"}})
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {})
+	if resp.Body != "{}" {
+		t.Errorf("Body of an empty 200 = %q, want %q", resp.Body, "{}")
+	}
+	resp = serve(t, ar, respond("text/plain", "kept"))
+	if resp.Body != "kept" {
+		t.Errorf("Body = %q, want the handler's", resp.Body)
+	}
+	resp = serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	if resp.Body != "" {
+		t.Errorf("Body of an empty 202 = %q, want it left empty", resp.Body)
+	}
+}
+
+func TestSingleValueHeaders(t *testing.T) {
+	doubled := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Content-Type", "text/plain")
+		w.Write([]byte("{}"))
+	}
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	resp := serve(t, ar, doubled)
+	if got := resp.MultiValueHeaders["Content-Type"]; len(got) != 1 || got[0] != "application/json" {
+		t.Errorf("Content-Type = %q, want only the first value", got)
+	}
+
+	ar.SetOptions(&AdapterOptions{SingleValueHeaders: []string{}})
+	resp = serve(t, ar, doubled)
+	if got := resp.MultiValueHeaders["Content-Type"]; len(got) != 2 {
+		t.Errorf("Content-Type with SingleValueHeaders off = %q, want both values", got)
+	}
+}
+
+func TestEmptyPath(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET"}
+	if got := handlerRequest(t, ar).URL.Path; got != "/" {
+		t.Errorf("Path = %q, want %q", got, "/")
+	}
+
+	ar.SetOptions(&AdapterOptions{RejectEmptyPath: true})
+	if _, err := ar.ToRequest(); errors.Cause(err) != ErrEmptyPath {
+		t.Errorf("ToRequest() with RejectEmptyPath returned %v, want ErrEmptyPath", err)
+	}
+}
+
+func TestRequestErrorResponses(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "POST", Path: "/", Body: "not base64!", IsBase64Encoded: true}
+	called := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+	if _, err := ar.Proxy(context.Background(), h); errors.Cause(err) != ErrInvalidBase64Body {
+		t.Errorf("Proxy() returned %v, want ErrInvalidBase64Body", err)
+	}
+
+	ar.SetOptions(&AdapterOptions{RequestErrorResponses: true})
+	resp := serve(t, ar, h)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("StatusCode = %d, want 400", resp.StatusCode)
+	}
+	var body errorBody
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil || body.Message == "" {
+		t.Errorf("Body = %q, %v, want a JSON message", resp.Body, err)
+	}
+	if called {
+		t.Error("Handler was called for a request that couldn't be built")
+	}
+}
+
+func TestJoinQueryValues(t *testing.T) {
+	ar := &AdapterRequest{
+		HTTPMethod:                      "GET",
+		Path:                            "/",
+		MultiValueQueryStringParameters: map[string][]string{"a": {"1", "2", "3"}},
+	}
+	ar.SetOptions(&AdapterOptions{JoinQueryValues: ","})
+	if got := handlerRequest(t, ar).URL.Query()["a"]; len(got) != 1 || got[0] != "1,2,3" {
+		t.Errorf("a = %q, want [1,2,3]", got)
+	}
+	if got := ar.Query()["a"]; len(got) != 1 || got[0] != "1,2,3" {
+		t.Errorf("Query() a = %q, want [1,2,3]", got)
+	}
+}
+
+func TestPlusAsSpace(t *testing.T) {
+	for _, tc := range []struct {
+		plusAsSpace bool
+		want        string
+	}{
+		{false, "a+b"},
+		{true, "a b"},
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/", QueryStringParameters: map[string]string{"q": "a+b"}}
+		ar.SetOptions(&AdapterOptions{PlusAsSpace: tc.plusAsSpace})
+		if got := handlerRequest(t, ar).URL.Query().Get("q"); got != tc.want {
+			t.Errorf("PlusAsSpace %v: q = %q, want %q", tc.plusAsSpace, got, tc.want)
+		}
+		if got := ar.Query().Get("q"); got != tc.want {
+			t.Errorf("PlusAsSpace %v: Query() q = %q, want %q", tc.plusAsSpace, got, tc.want)
+		}
+	}
+}
+
+func TestAuthorizationUnchanged(t *testing.T) {
+	const auth = "AWS4-HMAC-SHA256  Credential=AKID/20201014/us-east-1/execute-api/aws4_request,   SignedHeaders=host ,Signature=abc "
+	for name, ar := range map[string]*AdapterRequest{
+		"single value": {Headers: map[string]string{"authorization": auth}},
+		"multi value":  {MultiValueHeaders: map[string][]string{"Authorization": {auth}}},
+	} {
+		ar.HTTPMethod = "GET"
+		ar.Path = "/"
+		if got := handlerRequest(t, ar).Header.Get("Authorization"); got != auth {
+			t.Errorf("%s: Authorization = %q, want %q", name, got, auth)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	ready := false
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{Ready: func() bool { return ready }, RetryAfter: 1500 * time.Millisecond})
+	called := false
+	h := func(w http.ResponseWriter, r *http.Request) { called = true }
+
+	resp := serve(t, ar, h)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("StatusCode before ready = %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Headers["Retry-After"]; got != "2" {
+		t.Errorf("Retry-After = %q, want %q", got, "2")
+	}
+	if called {
+		t.Error("Handler was called before ready")
+	}
+
+	ready = true
+	if resp = serve(t, ar, h); resp.StatusCode != http.StatusOK || !called {
+		t.Errorf("StatusCode after ready = %d, handler called %v, want a 200 from the handler", resp.StatusCode, called)
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{ResponseHeaders: http.Header{
+		"Strict-Transport-Security": {"max-age=31536000"},
+		"x-content-type-options":    {"nosniff"},
+	}})
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=60")
+	})
+	if got := resp.Headers["Strict-Transport-Security"]; got != "max-age=60" {
+		t.Errorf("Strict-Transport-Security = %q, want the handler's value", got)
+	}
+	if got := resp.Headers["X-Content-Type-Options"]; got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want the default", got)
+	}
+}
+
+func TestTruncatedStreamedBody(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("a body cut short in transit"))
+	ar := &AdapterRequest{HTTPMethod: "POST", Path: "/", Body: encoded[:len(encoded)-3], IsBase64Encoded: true}
+	ar.SetOptions(&AdapterOptions{StreamBodyThreshold: 1})
+	r, err := ar.ToRequest()
+	if err != nil {
+		t.Fatalf("ToRequest: %v", err)
+	}
+	if _, err := ioutil.ReadAll(r.Body); errors.Cause(err) != ErrInvalidBase64Body {
+		t.Errorf("Reading a truncated body returned %v, want ErrInvalidBase64Body", err)
+	}
+}
+
+func TestBasePathExempt(t *testing.T) {
+	for p, want := range map[string]string{
+		"/v1/health":     "/v1/health",
+		"/v1/status/db":  "/v1/status/db",
+		"/v1/items/1":    "/items/1",
+		"/v1/status/a/b": "/status/a/b",
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: p}
+		ar.StripBasePath("v1")
+		ar.SetOptions(&AdapterOptions{BasePathExempt: []string{"/v1/health", "/v1/status/*"}})
+		if got := handlerRequest(t, ar).URL.Path; got != want {
+			t.Errorf("Path for %s = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestEnsureCharset(t *testing.T) {
+	for contentType, want := range map[string]string{
+		"text/plain":                "text/plain; charset=utf-8",
+		"text/html; charset=latin1": "text/html; charset=latin1",
+		"application/json":          "application/json",
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+		ar.SetOptions(&AdapterOptions{EnsureCharset: true})
+		if got := serve(t, ar, respond(contentType, "héllo")).Headers["Content-Type"]; got != want {
+			t.Errorf("Content-Type for %s = %q, want %q", contentType, got, want)
+		}
+	}
+
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	if got := serve(t, ar, respond("text/plain", "héllo")).Headers["Content-Type"]; got != "text/plain" {
+		t.Errorf("Content-Type without EnsureCharset = %q, want it unchanged", got)
+	}
+}
+
+func TestStrictNoContent(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+		w.Write([]byte("not allowed"))
+	}
+	ar := &AdapterRequest{HTTPMethod: "DELETE", Path: "/items/1"}
+	if resp := serve(t, ar, h); resp.StatusCode != http.StatusNoContent || resp.Body != "" {
+		t.Errorf("Lenient 204 gave %d %q, want the body dropped", resp.StatusCode, resp.Body)
+	}
+
+	ar.SetOptions(&AdapterOptions{StrictNoContent: true})
+	if _, err := ar.Proxy(context.Background(), http.HandlerFunc(h)); errors.Cause(err) != ErrBodyNotAllowed {
+		t.Errorf("Strict 204 returned %v, want ErrBodyNotAllowed", err)
+	}
+}
+
+func TestPathSelection(t *testing.T) {
+	for name, tc := range map[string]struct {
+		event string
+		want  string
+	}{
+		"rawPath wins":    {`{"rawPath": "/items", "requestContext": {"http": {"method": "GET", "path": "/prod/items"}}}`, "/items"},
+		"path wins":       {`{"httpMethod": "GET", "path": "/items", "requestContext": {"path": "/prod/items"}}`, "/items"},
+		"v2 context path": {`{"requestContext": {"http": {"method": "GET", "path": "/prod/items"}}}`, "/prod/items"},
+		"v1 context path": {`{"httpMethod": "GET", "requestContext": {"path": "/prod/items"}}`, "/prod/items"},
+	} {
+		ar := &AdapterRequest{}
+		if err := json.Unmarshal([]byte(tc.event), ar); err != nil {
+			t.Fatal(err)
+		}
+		if got := handlerRequest(t, ar).URL.Path; got != tc.want {
+			t.Errorf("%s: Path = %q, want %q", name, got, tc.want)
+		}
+	}
+}
+
+func TestStageVar(t *testing.T) {
+	ar := &AdapterRequest{StageVariables: map[string]string{"table": "items-prod", "empty": ""}}
+	for name, want := range map[string]string{"table": "items-prod", "empty": "", "missing": "fallback"} {
+		if got := ar.StageVar(name, "fallback"); got != want {
+			t.Errorf("StageVar(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStrippedRequestHeaders(t *testing.T) {
+	ar := &AdapterRequest{
+		HTTPMethod: "POST",
+		Path:       "/",
+		Headers:    map[string]string{"expect": "100-continue", "TE": "trailers", "X-Kept": "1"},
+	}
+	r := handlerRequest(t, ar)
+	for _, h := range []string{"Expect", "Te"} {
+		if got := r.Header.Get(h); got != "" {
+			t.Errorf("%s = %q, want it stripped", h, got)
+		}
+	}
+	if r.Header.Get("X-Kept") != "1" {
+		t.Error("X-Kept was stripped too")
+	}
+}
+
+func TestURLAfterStripBasePath(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/api/items", QueryStringParameters: map[string]string{"page": "2"}}
+	ar.StripBasePath("/api/")
+
+	u := handlerRequest(t, ar).URL
+	if u.Path != "/items" || u.Host != "aws-serverless-go-api.com" || u.RawQuery != "page=2" {
+		t.Errorf("URL = %q, want the base path stripped on the default host with the query", u)
+	}
+
+	t.Setenv(CustomHostVariable, "http://custom.example.com")
+	u = handlerRequest(t, ar).URL
+	if u.Path != "/items" || u.Host != "custom.example.com" || u.RawQuery != "page=2" {
+		t.Errorf("URL = %q, want the base path stripped on the custom host with the query", u)
+	}
+}
+
+func TestDetectJSON(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{DetectJSON: true})
+	if got := serve(t, ar, respond("", `{"ok": true}`)).Headers["Content-Type"]; got != "application/json" {
+		t.Errorf("Content-Type of a JSON body = %q, want application/json", got)
+	}
+	if got := serve(t, ar, respond("", "not json")).Headers["Content-Type"]; got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type of a text body = %q, want it sniffed", got)
+	}
+	if got := serve(t, ar, respond("application/vnd.api+json", `{}`)).Headers["Content-Type"]; got != "application/vnd.api+json" {
+		t.Errorf("Content-Type = %q, want the handler's", got)
+	}
+
+	ar.SetOptions(nil)
+	if got := serve(t, ar, respond("", `{"ok": true}`)).Headers["Content-Type"]; got == "application/json" {
+		t.Error("JSON was detected without DetectJSON")
+	}
+}
+
+func TestToRequestTwice(t *testing.T) {
+	ar := &AdapterRequest{
+		HTTPMethod:            "POST",
+		Path:                  "/foo",
+		QueryStringParameters: map[string]string{"a": "1"},
+		Headers:               map[string]string{"X-Custom": "1"},
+		Body:                  "body",
+	}
+	first, err := ar.ToRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ar.ToRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.URL.String() != second.URL.String() || second.URL.String() != "https://aws-serverless-go-api.com/foo?a=1" {
+		t.Errorf("URLs = %q and %q, want the same URL both times", first.URL, second.URL)
+	}
+	if ar.Path != "/foo" {
+		t.Errorf("Path = %q, ToRequest changed the event", ar.Path)
+	}
+	for _, r := range []*http.Request{first, second} {
+		if b, _ := ioutil.ReadAll(r.Body); string(b) != "body" {
+			t.Errorf("Body = %q, want %q", b, "body")
+		}
+	}
+}
+
+func TestMultiValueRequestHeaders(t *testing.T) {
+	ar := &AdapterRequest{
+		HTTPMethod:        "GET",
+		Path:              "/",
+		Headers:           map[string]string{"X-Custom": "b", "X-Single": "1"},
+		MultiValueHeaders: map[string][]string{"X-Custom": {"a", "b"}},
+	}
+	r := handlerRequest(t, ar)
+	if got := r.Header.Values("X-Custom"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("X-Custom = %q, want [a b]", got)
+	}
+	if got := r.Header.Get("X-Single"); got != "1" {
+		t.Errorf("X-Single = %q, want the header only in Headers kept", got)
+	}
+}
+
+func TestResponseHeadersPopulated(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	resp := serve(t, ar, respond("application/json", "{}"))
+	if got := resp.Headers["Content-Type"]; got != "application/json" {
+		t.Errorf("Headers[Content-Type] = %q, want application/json", got)
+	}
+	if got := resp.MultiValueHeaders["Content-Type"]; len(got) != 1 || got[0] != "application/json" {
+		t.Errorf("MultiValueHeaders[Content-Type] = %q, want [application/json]", got)
+	}
+}
+
+func TestAPIGatewayProxyResponseHeaders(t *testing.T) {
+	ar := &AdapterResponse{StatusCode: http.StatusOK, Headers: map[string]string{"X-Single": "1"}}
+	resp, err := ar.APIGatewayProxyResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Headers["X-Single"]; got != "1" {
+		t.Errorf("Headers[X-Single] = %q, want %q", got, "1")
+	}
+
+	ar = serve(t, &AdapterRequest{HTTPMethod: "GET", Path: "/"}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Single", "1")
+	})
+	if resp, _ = ar.APIGatewayProxyResponse(); resp.Headers["X-Single"] != "1" {
+		t.Errorf("Headers = %v, want X-Single from the handler", resp.Headers)
+	}
+}
+
+// waitForCancel is a slow handler, it takes a second or, when its request is
+// cancelled first, still needs a moment to wind down
+func waitForCancel(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-r.Context().Done():
+		time.Sleep(50 * time.Millisecond)
+	case <-time.After(time.Second):
+	}
+	w.Write([]byte("done"))
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	opts := &AdapterOptions{RouteTimeouts: map[string]time.Duration{
+		"/reports/*": 20 * time.Millisecond,
+		"/fast":      time.Minute,
+	}}
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/reports/yearly"}
+	ar.SetOptions(opts)
+	start := time.Now()
+	if resp := serve(t, ar, waitForCancel); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Slow route StatusCode = %d, want 504", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Slow route took %s, want it cut off at its timeout", elapsed)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/fast"}
+	ar.SetOptions(opts)
+	if resp := serve(t, ar, respond("text/plain", "ok")); resp.StatusCode != http.StatusOK {
+		t.Errorf("Fast route StatusCode = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestBinaryContentTypes(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg"><circle r="1"/></svg>`
+	for _, tc := range []struct {
+		contentType string
+		binaryTypes []string
+		want        bool
+	}{
+		{"image/svg+xml", nil, false},
+		{"image/png", nil, true},
+		{"application/pdf", nil, true},
+		{"video/vnd.custom+json", nil, false},
+		{"image/svg+xml", []string{"image/svg+xml"}, true},
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+		ar.SetOptions(&AdapterOptions{BinaryContentTypes: tc.binaryTypes})
+		resp := serve(t, ar, respond(tc.contentType, svg))
+		if resp.IsBase64Encoded != tc.want {
+			t.Errorf("%s with %q: IsBase64Encoded = %v, want %v", tc.contentType, tc.binaryTypes, resp.IsBase64Encoded, tc.want)
+		}
+		if !tc.want && resp.Body != svg {
+			t.Errorf("%s: Body = %q, want it as written", tc.contentType, resp.Body)
+		}
+	}
+}
+
+func TestMarshalStable(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"X-C", "X-A", "X-B", "X-E", "X-D"} {
+			w.Header().Set(name, "1")
+		}
+		w.Write([]byte(`{"b": 2, "a": 1}`))
+	}
+	var first []byte
+	for i := 0; i < 20; i++ {
+		b, err := serve(t, &AdapterRequest{HTTPMethod: "GET", Path: "/"}, h).MarshalStable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = b
+		} else if !bytes.Equal(b, first) {
+			t.Fatalf("MarshalStable() differed between runs:\n%s\n%s", first, b)
+		}
+	}
+	if !bytes.Contains(first, []byte(`"X-A": "1",
+    "X-B": "1"`)) {
+		t.Errorf("MarshalStable() didn't sort the headers:\n%s", first)
+	}
+}
+
+func TestV2Events(t *testing.T) {
+	ar := &AdapterRequest{}
+	if err := json.Unmarshal([]byte(`{
+		"version": "2.0",
+		"rawPath": "/search",
+		"rawQueryString": "q=a+b&tag=x&tag=y",
+		"cookies": ["session=abc", "theme=dark"],
+		"requestContext": {"http": {"method": "GET", "path": "/search"}}
+	}`), ar); err != nil {
+		t.Fatal(err)
+	}
+	ar.SetOptions(&AdapterOptions{PlusAsSpace: false})
+	r := handlerRequest(t, ar)
+	if r.Method != "GET" || r.URL.Path != "/search" || r.URL.RawQuery != "q=a+b&tag=x&tag=y" {
+		t.Errorf("Request = %s %s, want GET /search?q=a+b&tag=x&tag=y", r.Method, r.URL)
+	}
+	if got := r.URL.Query().Get("q"); got != "a b" {
+		t.Errorf("q = %q, want + in the raw query string decoded as a space", got)
+	}
+	if got := ar.Query()["tag"]; len(got) != 2 {
+		t.Errorf("Query() tag = %q, want both values", got)
+	}
+	if got := r.Header.Get("Cookie"); got != "session=abc; theme=dark" {
+		t.Errorf("Cookie = %q, want the cookies folded into one header", got)
+	}
+	if c, err := r.Cookie("theme"); err != nil || c.Value != "dark" {
+		t.Errorf("Cookie(theme) = %v, %v", c, err)
+	}
+
+	ar = &AdapterRequest{}
+	if err := json.Unmarshal([]byte(`{
+		"version": "2.0",
+		"rawPath": "/items",
+		"body": "`+base64.StdEncoding.EncodeToString([]byte(`{"name": "item"}`))+`",
+		"isBase64Encoded": true,
+		"requestContext": {"http": {"method": "POST", "path": "/items"}}
+	}`), ar); err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("Method = %q, want POST", r.Method)
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "id", Value: "1"})
+		w.WriteHeader(http.StatusCreated)
+	})
+	if string(body) != `{"name": "item"}` {
+		t.Errorf("Body = %q, want it base64 decoded", body)
+	}
+	v2, err := resp.APIGatewayV2HTTPResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.StatusCode != http.StatusCreated || len(v2.Cookies) != 1 || v2.Cookies[0] != "id=1" {
+		t.Errorf("APIGatewayV2HTTPResponse() = %d with cookies %q, want 201 with id=1", v2.StatusCode, v2.Cookies)
+	}
+}
+
+func TestTransformBody(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	var gotContentType string
+	ar.SetOptions(&AdapterOptions{TransformBody: func(contentType string, body []byte) []byte {
+		gotContentType = contentType
+		return bytes.ToUpper(body)
+	}})
+	resp := serve(t, ar, respond("text/plain", "shout"))
+	if resp.Body != "SHOUT" {
+		t.Errorf("Body = %q, want %q", resp.Body, "SHOUT")
+	}
+	if gotContentType != "text/plain" {
+		t.Errorf("TransformBody got content type %q, want text/plain", gotContentType)
+	}
+}
+
+func TestReplacedBodyContentLength(t *testing.T) {
+	withLength := func(statusCode int, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(statusCode)
+			io.WriteString(w, body)
+		}
+	}
+	for name, tc := range map[string]struct {
+		opts    *AdapterOptions
+		handler http.HandlerFunc
+		want    string
+	}{
+		"TransformBody": {&AdapterOptions{TransformBody: func(string, []byte) []byte {
+			return []byte("x")
+		}}, withLength(http.StatusOK, "hello world"), "1"},
+		"EmptyBodyDefaults": {&AdapterOptions{EmptyBodyDefaults: map[int]string{http.StatusNotFound: "not found"}}, withLength(http.StatusNotFound, ""), "9"},
+		"204":               {&AdapterOptions{}, withLength(http.StatusNoContent, "dropped"), ""},
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+		ar.SetOptions(tc.opts)
+		resp := serve(t, ar, tc.handler)
+		if got := resp.Headers["Content-Length"]; got != tc.want {
+			t.Errorf("%s: Content-Length = %q with body %q, want %q", name, got, resp.Body, tc.want)
+		}
+	}
+}
+
+func TestNullBody(t *testing.T) {
+	ar := &AdapterRequest{}
+	if err := json.Unmarshal([]byte(`{"httpMethod": "POST", "path": "/", "body": null, "isBase64Encoded": true}`), ar); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ar.ToRequest()
+	if err != nil {
+		t.Fatalf("ToRequest() of a null base64 body: %v", err)
+	}
+	if b, err := ioutil.ReadAll(r.Body); err != nil || len(b) != 0 || r.ContentLength != 0 {
+		t.Errorf("Body = %q, %v with ContentLength %d, want an empty body", b, err, r.ContentLength)
+	}
+}
+
+func TestV2Cookies(t *testing.T) {
+	resp := serve(t, &AdapterRequest{HTTPMethod: "GET", Path: "/"}, func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		w.Header().Set("X-Kept", "1")
+	})
+	v2, err := resp.APIGatewayV2HTTPResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v2.Cookies) != 2 || v2.Cookies[0] != "session=abc" || v2.Cookies[1] != "theme=dark" {
+		t.Errorf("Cookies = %q, want both", v2.Cookies)
+	}
+	if _, ok := v2.Headers["Set-Cookie"]; ok {
+		t.Error("Set-Cookie was left in Headers")
+	}
+	if _, ok := v2.MultiValueHeaders["Set-Cookie"]; ok {
+		t.Error("Set-Cookie was left in MultiValueHeaders")
+	}
+	if v2.Headers["X-Kept"] != "1" {
+		t.Errorf("Headers = %v, want X-Kept kept", v2.Headers)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	panicking := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Partial", "1")
+		panic("boom")
+	}
+	resp := serve(t, &AdapterRequest{HTTPMethod: "GET", Path: "/"}, panicking)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("StatusCode = %d, want 500", resp.StatusCode)
+	}
+	if _, ok := resp.Headers["X-Partial"]; ok {
+		t.Error("Headers the handler set before panicking leaked into the 500")
+	}
+
+	// The wrapping serveHTTP does, the channel has to be closed for it to
+	// stop waiting
+	var p *handlerPanic
+	ch := make(chan struct{})
+	requestDoneHandler(recoverHandler(http.HandlerFunc(panicking), &p), ch).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	select {
+	case <-ch:
+	default:
+		t.Error("Channel wasn't closed after the panic")
+	}
+	if p == nil || p.value != "boom" || len(p.stack) == 0 {
+		t.Errorf("Recovered %+v, want the panic value and stack", p)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	redirect := func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	}
+	for to, want := range map[string]string{
+		DefaultServerAddress + "/login?next=%2F": "https://api.example.com/login?next=%2F",
+		"/relative":                              "/relative",
+		"https://elsewhere.example.net/":         "https://elsewhere.example.net/",
+	} {
+		ar := eventWithContext(t, `{"domainName": "api.example.com"}`)
+		ar.HTTPMethod = "GET"
+		ar.Path = "/"
+		ar.QueryStringParameters = map[string]string{"to": to}
+		ar.SetOptions(&AdapterOptions{RewriteLocation: true})
+		if got := serve(t, ar, redirect).Headers["Location"]; got != want {
+			t.Errorf("Location for %s = %q, want %q", to, got, want)
+		}
+	}
+
+	ar := eventWithContext(t, `{"domainName": "api.example.com"}`)
+	ar.HTTPMethod = "GET"
+	ar.Path = "/"
+	ar.QueryStringParameters = map[string]string{"to": DefaultServerAddress + "/login"}
+	if got := serve(t, ar, redirect).Headers["Location"]; got != DefaultServerAddress+"/login" {
+		t.Errorf("Location without RewriteLocation = %q, want it unchanged", got)
+	}
+}
+
+func TestDeadlineMargin(t *testing.T) {
+	deadline := time.Now().Add(300 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/slow"}
+	ar.SetOptions(&AdapterOptions{DeadlineMargin: 200 * time.Millisecond})
+	handlerDeadline := make(chan time.Time, 1)
+	resp, err := ar.Proxy(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := r.Context().Deadline()
+		handlerDeadline <- d
+		waitForCancel(w, r)
+	}))
+	if err != nil {
+		t.Fatalf("Proxy: %v", err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("StatusCode = %d, want 504", resp.StatusCode)
+	}
+	if !time.Now().Before(deadline) {
+		t.Error("504 was only built after the invocation deadline")
+	}
+	if got, want := <-handlerDeadline, deadline.Add(-200*time.Millisecond); !got.Equal(want) {
+		t.Errorf("Handler deadline = %v, want the margin before the invocation's %v", got, want)
+	}
+
+	// A route timeout shorter than the cut-off still wins
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ar.SetOptions(&AdapterOptions{Timeout: 20 * time.Millisecond})
+	start := time.Now()
+	if resp, err = ar.Proxy(ctx, http.HandlerFunc(waitForCancel)); err != nil || resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Proxy() with a Timeout = %v, %v, want a 504", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Timeout took %s, want the route timeout to cut the handler off", elapsed)
+	}
+}
+
+func TestPropagatePanicsUnderDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{PropagatePanics: true})
+	defer func() {
+		if v := recover(); v != "boom" {
+			t.Errorf("Recovered %v, want the handler's panic on this goroutine", v)
+		}
+	}()
+	ar.Proxy(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("Handler isn't running under the deadline")
+		}
+		panic("boom")
+	}))
+	t.Error("Proxy returned instead of panicking")
+}
+
+func TestTimeout(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{Timeout: 20 * time.Millisecond})
+	late := make(chan struct{})
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		defer close(late)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("X-Late", "1")
+		w.Write([]byte("late"))
+	})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("StatusCode = %d, want 504", resp.StatusCode)
+	}
+	<-late
+	if _, ok := resp.Headers["X-Late"]; ok || strings.Contains(resp.Body, "late") {
+		t.Errorf("Late writes leaked into the response: %v %q", resp.Headers, resp.Body)
+	}
+
+	// The next response off the same request is the handler's own
+	ar.SetOptions(&AdapterOptions{Timeout: time.Minute})
+	if resp := serve(t, ar, respond("text/plain", "ok")); resp.StatusCode != http.StatusOK || resp.Body != "ok" {
+		t.Errorf("Response after a timeout = %d %q, want 200 ok", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	ar := eventWithContext(t, `{"requestId": "req-123"}`)
+	ar.HTTPMethod = "POST"
+	ar.Path = "/"
+	ar.Body = "not base64!"
+	ar.IsBase64Encoded = true
+	ar.SetOptions(&AdapterOptions{
+		RequestErrorResponses: true,
+		ErrorEnvelope:         map[string]string{"error": "{message}", "status": "{code}", "requestId": "{requestId}", "ref": "req:{requestId}"},
+	})
+	resp := serve(t, ar, respond("text/plain", "ok"))
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("Body %q isn't JSON: %v", resp.Body, err)
+	}
+	if body["requestId"] != "req-123" || body["ref"] != "req:req-123" {
+		t.Errorf("Body = %v, want the request id filled in", body)
+	}
+	if body["status"] != float64(http.StatusBadRequest) {
+		t.Errorf("status = %#v, want the code as a number", body["status"])
+	}
+	if msg, _ := body["error"].(string); msg == "" {
+		t.Errorf("error = %#v, want the message", body["error"])
+	}
+	if _, ok := body["message"]; ok {
+		t.Error("Default message field was kept next to the envelope")
+	}
+}
+
+func TestSortedQuery(t *testing.T) {
+	for name, ar := range map[string]*AdapterRequest{
+		"multi value":  {MultiValueQueryStringParameters: map[string][]string{"d": {"4"}, "b": {"2", "1"}, "a": {"0"}, "c": {"3"}, "e": {"5"}}},
+		"single value": {QueryStringParameters: map[string]string{"d": "4", "b": "2", "a": "0", "c": "3", "e": "5"}},
+	} {
+		want := "a=0&b=2&b=1&c=3&d=4&e=5"
+		if name == "single value" {
+			want = "a=0&b=2&c=3&d=4&e=5"
+		}
+		ar.HTTPMethod = "GET"
+		ar.Path = "/"
+		for i := 0; i < 20; i++ {
+			if got := handlerRequest(t, ar).URL.RawQuery; got != want {
+				t.Fatalf("%s: RawQuery = %q, want %q", name, got, want)
+			}
+		}
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	for name, requestContext := range map[string]string{
+		"v1": `{"identity": {"sourceIp": "203.0.113.7"}}`,
+		"v2": `{"http": {"method": "GET", "sourceIp": "203.0.113.7"}}`,
+	} {
+		ar := eventWithContext(t, requestContext)
+		ar.HTTPMethod = "GET"
+		ar.Path = "/"
+		r := handlerRequest(t, ar)
+		if r.RemoteAddr != "203.0.113.7:0" {
+			t.Errorf("%s: RemoteAddr = %q, want %q", name, r.RemoteAddr, "203.0.113.7:0")
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || host != "203.0.113.7" {
+			t.Errorf("%s: SplitHostPort() = %q, %v", name, host, err)
+		}
+	}
+
+	ar := eventWithContext(t, `{"identity": {"sourceIp": "2001:db8::1"}}`)
+	ar.HTTPMethod = "GET"
+	ar.Path = "/"
+	if got := handlerRequest(t, ar).RemoteAddr; got != "[2001:db8::1]:0" {
+		t.Errorf("RemoteAddr of an IPv6 client = %q, want %q", got, "[2001:db8::1]:0")
+	}
+}
+
+func TestConflictingResponseHeaders(t *testing.T) {
+	ar := &AdapterResponse{
+		StatusCode:        http.StatusOK,
+		Headers:           map[string]string{"content-type": "text/plain", "X-Only-Single": "1"},
+		MultiValueHeaders: map[string][]string{"Content-Type": {"application/json"}},
+	}
+	v1, _ := ar.APIGatewayProxyResponse()
+	alb, _ := ar.ALBTargetGroupResponse()
+	v2, _ := ar.APIGatewayV2HTTPResponse()
+	for name, headers := range map[string]map[string]string{"v1": v1.Headers, "ALB": alb.Headers, "v2": v2.Headers} {
+		if _, ok := headers["content-type"]; ok {
+			t.Errorf("%s: the conflicting single value was kept: %v", name, headers)
+		}
+		if headers["Content-Type"] != "application/json" {
+			t.Errorf("%s: Content-Type = %q, want the multi value one", name, headers["Content-Type"])
+		}
+		if headers["X-Only-Single"] != "1" {
+			t.Errorf("%s: X-Only-Single = %q, want it kept", name, headers["X-Only-Single"])
+		}
+	}
+	if ar.Headers["content-type"] != "text/plain" {
+		t.Error("Resolving the conflict changed the AdapterResponse")
+	}
+}
+
+func TestMaxResponseHeaderCount(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Add("X-A", "1")
+		w.Header().Add("X-A", "2")
+	}
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{MaxResponseHeaderCount: 2})
+	if _, err := ar.Proxy(context.Background(), http.HandlerFunc(h)); errors.Cause(err) != ErrTooManyHeaders {
+		t.Errorf("Proxy() with 3 header values and a limit of 2 returned %v, want ErrTooManyHeaders", err)
+	}
+
+	ar.SetOptions(&AdapterOptions{MaxResponseHeaderCount: 3})
+	serve(t, ar, h)
+}
+
+func TestForwardedFor(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		forwardedFor bool
+		headers      map[string]string
+		want         string
+	}{
+		{"absent", true, nil, "203.0.113.7"},
+		{"present", true, map[string]string{"x-forwarded-for": "198.51.100.1, 203.0.113.7"}, "198.51.100.1, 203.0.113.7"},
+		{"off", false, nil, ""},
+	} {
+		ar := eventWithContext(t, `{"identity": {"sourceIp": "203.0.113.7"}}`)
+		ar.HTTPMethod = "GET"
+		ar.Path = "/"
+		ar.Headers = tc.headers
+		ar.SetOptions(&AdapterOptions{ForwardedFor: tc.forwardedFor})
+		if got := handlerRequest(t, ar).Header.Values("X-Forwarded-For"); strings.Join(got, "|") != tc.want {
+			t.Errorf("%s: X-Forwarded-For = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	for proto, want := range map[string]string{"http": "http", "https": "https", "HTTPS, http": "https"} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"X-Forwarded-Proto": proto}}
+		r := handlerRequest(t, ar)
+		if r.URL.Scheme != want {
+			t.Errorf("%s: Scheme = %q, want %q", proto, r.URL.Scheme, want)
+		}
+		if (r.TLS != nil) != (want == "https") {
+			t.Errorf("%s: TLS = %v, want it set only for https", proto, r.TLS)
+		}
+	}
+
+	// Without the header the default https address decides
+	if r := handlerRequest(t, &AdapterRequest{HTTPMethod: "GET", Path: "/"}); r.URL.Scheme != "https" || r.TLS == nil {
+		t.Errorf("Scheme = %q and TLS %v without X-Forwarded-Proto, want https", r.URL.Scheme, r.TLS)
+	}
+}
+
+func TestPathParam(t *testing.T) {
+	ar := &AdapterRequest{PathParameters: map[string]string{"name": "caf%C3%A9%20au%20lait", "bad": "100%"}}
+	if got := ar.PathParam("name"); got != "café au lait" {
+		t.Errorf("PathParam(name) = %q, want %q", got, "café au lait")
+	}
+	if got := ar.PathParam("bad"); got != "100%" {
+		t.Errorf("PathParam(bad) = %q, want it as is", got)
+	}
+	if got := ar.PathParam("missing"); got != "" {
+		t.Errorf("PathParam(missing) = %q, want empty", got)
+	}
+}
+
+func TestHijack(t *testing.T) {
+	var hijackErr error
+	resp := serve(t, &AdapterRequest{HTTPMethod: "GET", Path: "/ws"}, func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("ResponseWriter doesn't implement http.Hijacker")
+		}
+		_, _, hijackErr = hj.Hijack()
+		w.Write([]byte("fallback"))
+	})
+	if hijackErr != ErrHijackNotSupported {
+		t.Errorf("Hijack() returned %v, want ErrHijackNotSupported", hijackErr)
+	}
+	if resp.StatusCode != http.StatusInternalServerError || strings.Contains(resp.Body, "fallback") {
+		t.Errorf("Response = %d %q, want a 500 without the handler's writes", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestHost(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{ServerAddress: "https://configured.example.com"})
+	if r := handlerRequest(t, ar); r.Host != "configured.example.com" || r.Header.Get("Host") != "configured.example.com" {
+		t.Errorf("Host = %q with header %q, want the configured host", r.Host, r.Header.Get("Host"))
+	}
+
+	t.Setenv(CustomHostVariable, "https://env.example.com")
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"Host": "client.example.com"}}
+	if r := handlerRequest(t, ar); r.Host != "env.example.com" {
+		t.Errorf("Host = %q, want the host from %s", r.Host, CustomHostVariable)
+	}
+}
+
+func TestHostFromEvent(t *testing.T) {
+	forwarded := map[string]string{"Host": "api.example.com", "X-Forwarded-Host": "public.example.com, proxy"}
+	for name, tc := range map[string]struct {
+		headers map[string]string
+		trust   bool
+		want    string
+	}{
+		"Host":                     {map[string]string{"Host": "client.example.com"}, false, "client.example.com"},
+		"X-Forwarded-Host":         {forwarded, false, "api.example.com"},
+		"trusted X-Forwarded-Host": {forwarded, true, "public.example.com"},
+		"none":                     {nil, false, "aws-serverless-go-api.com"},
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: tc.headers}
+		ar.SetOptions(&AdapterOptions{TrustForwardedHost: tc.trust})
+		r := handlerRequest(t, ar)
+		if r.Host != tc.want || r.Header.Get("Host") != tc.want {
+			t.Errorf("%s: Host = %q with header %q, want %q", name, r.Host, r.Header.Get("Host"), tc.want)
+		}
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	const body = `{"name": "item"}`
+	for name, ar := range map[string]*AdapterRequest{
+		"plain":  {Body: body},
+		"base64": {Body: base64.StdEncoding.EncodeToString([]byte(body)), IsBase64Encoded: true},
+	} {
+		ar.HTTPMethod = "POST"
+		ar.Path = "/"
+		var read []byte
+		serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength != int64(len(body)) {
+				t.Errorf("%s: ContentLength = %d, want %d", name, r.ContentLength, len(body))
+			}
+			read, _ = ioutil.ReadAll(r.Body)
+		})
+		if string(read) != body {
+			t.Errorf("%s: Body = %q, want %q", name, read, body)
+		}
+	}
+}
+
+func TestDecompressRequests(t *testing.T) {
+	const body = `{"name": "item"}`
+	newRequest := func() *AdapterRequest {
+		return &AdapterRequest{
+			HTTPMethod:      "POST",
+			Path:            "/",
+			Headers:         map[string]string{"Content-Type": "application/json", "Content-Encoding": "gzip"},
+			Body:            base64.StdEncoding.EncodeToString(gzipped(t, body)),
+			IsBase64Encoded: true,
+		}
+	}
+	h := func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil || v["name"] != "item" {
+			t.Errorf("Handler decoded %v, %v, want the plain JSON", v, err)
+		}
+		if got := r.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("Content-Encoding = %q, want it removed", got)
+		}
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("ContentLength = %d, want %d", r.ContentLength, len(body))
+		}
+	}
+	ar := newRequest()
+	ar.SetOptions(&AdapterOptions{DecompressRequests: true})
+	serve(t, ar, h)
+
+	var wire []byte
+	serve(t, newRequest(), func(w http.ResponseWriter, r *http.Request) {
+		wire, _ = ioutil.ReadAll(r.Body)
+	})
+	if !bytes.Equal(wire, gzipped(t, body)) {
+		t.Error("Body was decompressed without DecompressRequests")
+	}
+
+	ar = newRequest()
+	ar.Body = base64.StdEncoding.EncodeToString([]byte("not gzip"))
+	ar.SetOptions(&AdapterOptions{DecompressRequests: true})
+	if _, err := ar.ToRequest(); errors.Cause(err) != ErrInvalidGzipBody {
+		t.Errorf("ToRequest() of a broken gzip body returned %v, want ErrInvalidGzipBody", err)
+	}
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	body := strings.Repeat("a", 1024)
+	newRequest := func(max int64) *AdapterRequest {
+		ar := &AdapterRequest{
+			HTTPMethod:      "POST",
+			Path:            "/",
+			Headers:         map[string]string{"Content-Encoding": "gzip"},
+			Body:            base64.StdEncoding.EncodeToString(gzipped(t, body)),
+			IsBase64Encoded: true,
+		}
+		ar.SetOptions(&AdapterOptions{DecompressRequests: true, MaxDecompressedSize: max})
+		return ar
+	}
+	if _, err := newRequest(1024).ToRequest(); err != nil {
+		t.Errorf("ToRequest() of a body right at the limit: %v", err)
+	}
+	if _, err := newRequest(1023).ToRequest(); errors.Cause(err) != ErrInvalidGzipBody {
+		t.Errorf("ToRequest() of a body one byte over the limit returned %v, want ErrInvalidGzipBody", err)
+	}
+}
+
+func TestDisableSniffing(t *testing.T) {
+	const html = "<html><body>hi</body></html>"
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	if got := serve(t, ar, respond("", html)).Headers["Content-Type"]; got != "text/html; charset=utf-8" {
+		t.Errorf("Sniffed Content-Type = %q, want text/html", got)
+	}
+
+	ar.SetOptions(&AdapterOptions{DisableSniffing: true})
+	resp := serve(t, ar, respond("", html))
+	if _, ok := resp.MultiValueHeaders["Content-Type"]; ok {
+		t.Errorf("Content-Type = %q with DisableSniffing, want none", resp.Headers["Content-Type"])
+	}
+	if resp.Body != html {
+		t.Errorf("Body = %q, want it as written", resp.Body)
+	}
+	if got := serve(t, ar, respond("text/csv", "a,b")).Headers["Content-Type"]; got != "text/csv" {
+		t.Errorf("Content-Type = %q, want the handler's kept", got)
+	}
+}
+
+func TestHandlerDisablesSniffing(t *testing.T) {
+	const html = "<html><body>hi</body></html>"
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{DetectJSON: true})
+	resp := serve(t, ar, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		io.WriteString(w, html)
+	}))
+	if got := resp.MultiValueHeaders["Content-Type"]; len(got) != 0 {
+		t.Errorf("Content-Type = %q after the handler turned sniffing off, want none", got)
+	}
+	if resp.Body != html {
+		t.Errorf("Body = %q, want it as written", resp.Body)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var capturedReq *AdapterRequest
+	var capturedResp *AdapterResponse
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/items"}
+	ar.SetOptions(&AdapterOptions{Capture: func(req *AdapterRequest, resp *AdapterResponse) {
+		capturedReq, capturedResp = req, resp
+	}})
+	resp := serve(t, ar, respond("text/plain", "ok"))
+	if capturedReq != ar || capturedResp != resp {
+		t.Errorf("Capture got %p and %p, want the event %p and the response %p", capturedReq, capturedResp, ar, resp)
+	}
+	if capturedResp.Body != "ok" || capturedReq.Path != "/items" {
+		t.Errorf("Capture got %q for %q", capturedResp.Body, capturedReq.Path)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		sent        int
+	}{
+		{"text", "text/plain", strings.Repeat("a", 300), 300},
+		// base64 turns every 3 bytes into 4
+		{"binary", "application/octet-stream", strings.Repeat("a", 300), 400},
+	} {
+		ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+		ar.SetOptions(&AdapterOptions{MaxResponseSize: tc.sent})
+		if resp := serve(t, ar, respond(tc.contentType, tc.body)); len(resp.Body) != tc.sent {
+			t.Errorf("%s: Body is %d bytes, want %d", tc.name, len(resp.Body), tc.sent)
+		}
+
+		ar.SetOptions(&AdapterOptions{MaxResponseSize: tc.sent - 1})
+		if _, err := ar.Proxy(context.Background(), respond(tc.contentType, tc.body)); errors.Cause(err) != ErrResponseTooLarge {
+			t.Errorf("%s: Proxy() one byte over returned %v, want ErrResponseTooLarge", tc.name, err)
+		}
+
+		ar.SetOptions(&AdapterOptions{MaxResponseSize: tc.sent - 1, ResponseTooLargeResponses: true})
+		if resp := serve(t, ar, respond(tc.contentType, tc.body)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: StatusCode one byte over = %d, want 413", tc.name, resp.StatusCode)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	content := strings.NewReader("0123456789abcdef")
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/file.txt", Headers: map[string]string{"Range": "bytes=4-9"}}
+	ar.SetOptions(&AdapterOptions{GzipResponses: true, GzipMinSize: 1})
+	ar.Headers["Accept-Encoding"] = "gzip"
+	resp := serve(t, ar, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "file.txt", time.Time{}, content)
+	})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("StatusCode = %d, want 206", resp.StatusCode)
+	}
+	if got := resp.Headers["Content-Range"]; got != "bytes 4-9/16" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes 4-9/16")
+	}
+	if resp.Body != "456789" || resp.IsBase64Encoded {
+		t.Errorf("Body = %q, want the plain range %q", resp.Body, "456789")
+	}
+	if resp.Headers["Content-Length"] != "6" || resp.Headers["Content-Encoding"] != "" {
+		t.Errorf("Headers = %v, want an uncompressed 6 byte body", resp.Headers)
+	}
+}
@@ -0,0 +1,118 @@
+package awseventadapter
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// contextKey is unexported so values the adapter puts on the request context
+// can't collide with anyone else's
+type contextKey int
+
+const (
+	stageContextKey contextKey = iota
+	correlationIDContextKey
+	base64ContextKey
+)
+
+// headerContextKey keys the values promoted from headers by the
+// ContextHeaders option
+type headerContextKey string
+
+// withContextValues adds the body encoding and the values the options ask for
+// to the context handed to the handler
+func (ar *AdapterRequest) withContextValues(ctx context.Context) context.Context {
+	opts := ar.opts()
+	ctx = context.WithValue(ctx, base64ContextKey, ar.IsBase64Encoded)
+	if opts.InjectStage {
+		ctx = context.WithValue(ctx, stageContextKey, ar.Stage())
+	}
+	for header, key := range opts.ContextHeaders {
+		if v, ok := ar.header(header); ok {
+			ctx = context.WithValue(ctx, headerContextKey(key), v)
+		}
+	}
+	return ctx
+}
+
+// StageFromContext returns the API Gateway stage injected by the InjectStage
+// option, use it from a handler with r.Context()
+func StageFromContext(ctx context.Context) (string, bool) {
+	stage, ok := ctx.Value(stageContextKey).(string)
+	return stage, ok
+}
+
+// IsBase64EncodedFromContext reports whether the event body arrived base64
+// encoded, the handler always sees it decoded
+func IsBase64EncodedFromContext(ctx context.Context) bool {
+	encoded, _ := ctx.Value(base64ContextKey).(bool)
+	return encoded
+}
+
+// ContextValue returns a header value promoted onto the context by the
+// ContextHeaders option, key is the context key the header was mapped to
+func ContextValue(ctx context.Context, key string) (string, bool) {
+	v, ok := ctx.Value(headerContextKey(key)).(string)
+	return v, ok
+}
+
+// correlationID returns the event's id in header, generating one when the
+// client didn't send it, or "" when header is empty
+func (ar *AdapterRequest) correlationID(header string) string {
+	if header == "" {
+		return ""
+	}
+	if id, _ := ar.header(header); id != "" {
+		return id
+	}
+	return newCorrelationID()
+}
+
+// withCorrelationID puts the correlation id in header on the request and its
+// context, leaving the request alone when id is empty
+func withCorrelationID(r *http.Request, header, id string) *http.Request {
+	if id == "" {
+		return r
+	}
+	r.Header.Set(header, id)
+	return r.WithContext(context.WithValue(r.Context(), correlationIDContextKey, id))
+}
+
+// newCorrelationID returns a random (version 4) UUID
+func newCorrelationID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand doesn't fail on Lambda's Linux, but an id is still better
+		// than none
+		return "00000000-0000-4000-8000-000000000000"
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// CorrelationIDFromContext returns the correlation id of the request when the
+// CorrelationHeader option is set, use it from a handler with r.Context()
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDContextKey).(string)
+	return id, ok
+}
+
+// RemainingTime returns how long is left until the context's deadline, which
+// for a lambda invocation is when Lambda stops it. Use it from a handler with
+// r.Context() to budget work, there the deadline is when Proxy gives up on
+// the handler, the DeadlineMargin before Lambda's. It's zero once the deadline
+// has passed or when the context has none.
+func RemainingTime(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if remaining := time.Until(deadline); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
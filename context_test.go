@@ -0,0 +1,122 @@
+package awseventadapter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInjectStage(t *testing.T) {
+	ar := eventWithContext(t, `{"stage": "prod"}`)
+	ar.HTTPMethod = "GET"
+	ar.Path = "/"
+	if got := ar.Stage(); got != "prod" {
+		t.Errorf("Stage() = %q, want %q", got, "prod")
+	}
+
+	if _, ok := StageFromContext(handlerRequest(t, ar).Context()); ok {
+		t.Error("Stage reached the context without InjectStage")
+	}
+	ar.SetOptions(&AdapterOptions{InjectStage: true})
+	stage, ok := StageFromContext(handlerRequest(t, ar).Context())
+	if !ok || stage != "prod" {
+		t.Errorf("StageFromContext() = %q, %v, want %q, true", stage, ok, "prod")
+	}
+}
+
+func TestContextHeaders(t *testing.T) {
+	ar := &AdapterRequest{
+		HTTPMethod: "GET",
+		Path:       "/",
+		Headers:    map[string]string{"x-tenant-id": "acme"},
+	}
+	ar.SetOptions(&AdapterOptions{ContextHeaders: map[string]string{"X-Tenant-Id": "tenant"}})
+	ctx := handlerRequest(t, ar).Context()
+	if v, ok := ContextValue(ctx, "tenant"); !ok || v != "acme" {
+		t.Errorf("ContextValue(tenant) = %q, %v, want %q, true", v, ok, "acme")
+	}
+	if _, ok := ContextValue(ctx, "X-Tenant-Id"); ok {
+		t.Error("Header name was used as the context key")
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	opts := &AdapterOptions{CorrelationHeader: "X-Correlation-Id"}
+	var fromContext, fromHeader string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fromContext, _ = CorrelationIDFromContext(r.Context())
+		fromHeader = r.Header.Get("X-Correlation-Id")
+	})
+
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(opts)
+	resp := serve(t, ar, h)
+	if len(fromContext) != 36 || fromHeader != fromContext {
+		t.Errorf("Generated id = %q in the context and %q in the header, want the same UUID", fromContext, fromHeader)
+	}
+	if got := resp.Headers["X-Correlation-Id"]; got != fromContext {
+		t.Errorf("Response id = %q, want the generated %q", got, fromContext)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"x-correlation-id": "abc-123"}}
+	ar.SetOptions(opts)
+	resp = serve(t, ar, h)
+	if fromContext != "abc-123" || fromHeader != "abc-123" {
+		t.Errorf("Id = %q in the context and %q in the header, want the incoming one", fromContext, fromHeader)
+	}
+	if got := resp.Headers["X-Correlation-Id"]; got != "abc-123" {
+		t.Errorf("Response id = %q, want it echoed", got)
+	}
+
+	if _, ok := CorrelationIDFromContext(context.Background()); ok {
+		t.Error("CorrelationIDFromContext() found an id in an empty context")
+	}
+}
+
+func TestCorrelationIDOnErrorResponses(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"X-Correlation-Id": "abc"}}
+	ar.SetOptions(&AdapterOptions{CorrelationHeader: "X-Correlation-Id", Timeout: 20 * time.Millisecond})
+	resp := serve(t, ar, waitForCancel)
+	if resp.StatusCode != http.StatusGatewayTimeout || resp.Headers["X-Correlation-Id"] != "abc" {
+		t.Errorf("Timed out request got %d with id %q, want a 504 with the incoming id", resp.StatusCode, resp.Headers["X-Correlation-Id"])
+	}
+
+	ar.SetOptions(&AdapterOptions{CorrelationHeader: "X-Correlation-Id", Ready: func() bool { return false }})
+	if got := serve(t, ar, waitForCancel).Headers["X-Correlation-Id"]; got != "abc" {
+		t.Errorf("Not ready response id = %q, want the incoming id", got)
+	}
+}
+
+func TestRemainingTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	first := RemainingTime(ctx)
+	if first <= 0 || first > time.Minute {
+		t.Fatalf("RemainingTime() = %s, want up to a minute", first)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if second := RemainingTime(ctx); second >= first {
+		t.Errorf("RemainingTime() went from %s to %s, want it to decrease", first, second)
+	}
+
+	if got := RemainingTime(context.Background()); got != 0 {
+		t.Errorf("RemainingTime() without a deadline = %s, want 0", got)
+	}
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if got := RemainingTime(expired); got != 0 {
+		t.Errorf("RemainingTime() past the deadline = %s, want 0", got)
+	}
+}
+
+func TestIsBase64EncodedFromContext(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "POST", Path: "/", Body: "aGVsbG8=", IsBase64Encoded: true}
+	if !IsBase64EncodedFromContext(handlerRequest(t, ar).Context()) {
+		t.Error("IsBase64EncodedFromContext() = false for a base64 request")
+	}
+	ar = &AdapterRequest{HTTPMethod: "POST", Path: "/", Body: "hello"}
+	if IsBase64EncodedFromContext(handlerRequest(t, ar).Context()) {
+		t.Error("IsBase64EncodedFromContext() = true for a plain request")
+	}
+}
@@ -0,0 +1,98 @@
+package awseventadapter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request
+// Origin, empty when CORS is off or the origin isn't allowed
+func (o *AdapterOptions) allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, pattern := range o.CORSOrigins {
+		if pattern == "*" {
+			return "*"
+		}
+		if originMatches(pattern, origin) {
+			return origin
+		}
+	}
+	for _, re := range o.CORSOriginPatterns {
+		if re.MatchString(origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// originMatches compares an origin to a CORSOrigins entry, a * in the entry
+// stands for one or more subdomains
+func originMatches(pattern, origin string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return strings.EqualFold(pattern, origin)
+	}
+	prefix, suffix := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+	origin = strings.ToLower(origin)
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	// The wildcard can't swallow a port or path, https://*.example.com isn't
+	// https://evil.com/.example.com
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:@")
+}
+
+// corsHeaders adds Access-Control-Allow-Origin to a response for an allowed
+// origin, unless the handler set it itself
+func (ar *AdapterRequest) corsHeaders(h http.Header) {
+	opts := ar.opts()
+	if len(opts.CORSOrigins) == 0 && len(opts.CORSOriginPatterns) == 0 {
+		return
+	}
+	origin, _ := ar.header("Origin")
+	allowed := opts.allowedOrigin(origin)
+	if allowed != "*" {
+		// The answer differs per origin, caches have to keep them apart
+		addVary(h, "Origin")
+	}
+	if allowed != "" && h.Get("Access-Control-Allow-Origin") == "" {
+		h.Set("Access-Control-Allow-Origin", allowed)
+	}
+}
+
+// preflightResponse answers a CORS preflight from an allowed origin with a 204
+// allowing the requested method and headers. It reports false for anything
+// else, which goes to the handler as usual.
+func (ar *AdapterRequest) preflightResponse() (*AdapterResponse, bool, error) {
+	method := ar.HTTPMethod
+	if method == "" {
+		method = ar.requestContextString("http", "method")
+	}
+	requestMethod, ok := ar.header("Access-Control-Request-Method")
+	if !strings.EqualFold(method, http.MethodOptions) || !ok {
+		return nil, false, nil
+	}
+	origin, _ := ar.header("Origin")
+	if ar.opts().allowedOrigin(origin) == "" {
+		return nil, false, nil
+	}
+
+	w := httptest.NewRecorder()
+	ar.corsHeaders(w.Header())
+	w.Header().Set("Access-Control-Allow-Methods", requestMethod)
+	if requestHeaders, ok := ar.header("Access-Control-Request-Headers"); ok {
+		w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	aresp, err := newAdapterResponse(w.Result(), false, ar.opts())
+	if err != nil {
+		return nil, true, errors.Wrap(err, "Unable to convert preflight response into AdapterResponse")
+	}
+	return aresp, true, nil
+}
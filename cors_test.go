@@ -0,0 +1,95 @@
+package awseventadapter
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// corsRequest returns a GET from origin with the CORS options set
+func corsRequest(origin string, opts *AdapterOptions) *AdapterRequest {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"Origin": origin}}
+	ar.SetOptions(opts)
+	return ar
+}
+
+func TestCORSOrigins(t *testing.T) {
+	opts := &AdapterOptions{
+		CORSOrigins:        []string{"https://app.example.com", "https://*.example.org"},
+		CORSOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^https://pr-[0-9]+\.preview\.example\.net$`)},
+	}
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":           true,
+		"https://APP.example.com":           true,
+		"https://other.example.com":         false,
+		"https://api.example.org":           true,
+		"https://a.b.example.org":           true,
+		"https://example.org":               false,
+		"https://evil.com/.example.org":     false,
+		"https://pr-42.preview.example.net": true,
+		"https://pr-x.preview.example.net":  false,
+		"http://app.example.com":            false,
+	} {
+		resp := serve(t, corsRequest(origin, opts), respond("text/plain", "ok"))
+		got := resp.Headers["Access-Control-Allow-Origin"]
+		if allowed && got != origin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want the origin", origin, got)
+		}
+		if !allowed && got != "" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want it denied", origin, got)
+		}
+		if resp.Headers["Vary"] != "Origin" {
+			t.Errorf("%s: Vary = %q, want Origin", origin, resp.Headers["Vary"])
+		}
+	}
+
+	resp := serve(t, corsRequest("https://anything.test", &AdapterOptions{CORSOrigins: []string{"*"}}), respond("text/plain", "ok"))
+	if got := resp.Headers["Access-Control-Allow-Origin"]; got != "*" {
+		t.Errorf("Access-Control-Allow-Origin with * = %q, want *", got)
+	}
+
+	resp = serve(t, corsRequest("https://app.example.com", nil), respond("text/plain", "ok"))
+	if _, ok := resp.Headers["Access-Control-Allow-Origin"]; ok {
+		t.Error("Access-Control-Allow-Origin was set without CORSOrigins")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	opts := &AdapterOptions{CORSOrigins: []string{"https://*.example.com"}}
+	called := false
+	h := func(w http.ResponseWriter, r *http.Request) { called = true }
+
+	ar := corsRequest("https://app.example.com", opts)
+	ar.HTTPMethod = "OPTIONS"
+	ar.Headers["Access-Control-Request-Method"] = "PUT"
+	ar.Headers["Access-Control-Request-Headers"] = "Content-Type"
+	resp := serve(t, ar, h)
+	if resp.StatusCode != http.StatusNoContent || called {
+		t.Errorf("Preflight gave %d, handler called %v, want a 204 without the handler", resp.StatusCode, called)
+	}
+	if resp.Headers["Access-Control-Allow-Origin"] != "https://app.example.com" ||
+		resp.Headers["Access-Control-Allow-Methods"] != "PUT" ||
+		resp.Headers["Access-Control-Allow-Headers"] != "Content-Type" {
+		t.Errorf("Preflight headers = %v", resp.Headers)
+	}
+
+	ar.Headers["Origin"] = "https://evil.test"
+	if resp = serve(t, ar, h); !called || resp.Headers["Access-Control-Allow-Origin"] != "" {
+		t.Errorf("Denied preflight didn't go to the handler untouched: %v", resp.Headers)
+	}
+}
+
+func TestCORSOnErrorResponses(t *testing.T) {
+	ar := corsRequest("https://app.example.com", &AdapterOptions{
+		CORSOrigins: []string{"https://app.example.com"},
+		Timeout:     20 * time.Millisecond,
+	})
+	resp := serve(t, ar, waitForCancel)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("StatusCode = %d, want 504", resp.StatusCode)
+	}
+	if got := resp.Headers["Access-Control-Allow-Origin"]; got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q on the 504, want the origin", got)
+	}
+}
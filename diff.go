@@ -0,0 +1,68 @@
+package awseventadapter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiffResponses returns a readable diff of two AdapterResponses, one line per
+// differing field prefixed with - for a and + for b. It returns "" when they
+// match, which makes it easy to use in golden tests.
+func DiffResponses(a, b *AdapterResponse) string {
+	if a == nil || b == nil {
+		if a == b {
+			return ""
+		}
+		return fmt.Sprintf("- %v\n+ %v\n", a, b)
+	}
+
+	var sb strings.Builder
+	diff := func(field string, av, bv interface{}) {
+		if av == bv {
+			return
+		}
+		fmt.Fprintf(&sb, "- %s: %#v\n+ %s: %#v\n", field, av, field, bv)
+	}
+
+	diff("StatusCode", a.StatusCode, b.StatusCode)
+	diff("StatusDescription", a.StatusDescription, b.StatusDescription)
+	seen := map[string]struct{}{}
+	for k := range a.Headers {
+		seen[k] = struct{}{}
+	}
+	for k := range b.Headers {
+		seen[k] = struct{}{}
+	}
+	for _, k := range sortedKeys(seen) {
+		diff(fmt.Sprintf("Headers[%q]", k), a.Headers[k], b.Headers[k])
+	}
+
+	seen = map[string]struct{}{}
+	for k := range a.MultiValueHeaders {
+		seen[k] = struct{}{}
+	}
+	for k := range b.MultiValueHeaders {
+		seen[k] = struct{}{}
+	}
+	for _, k := range sortedKeys(seen) {
+		// Slices aren't comparable, compare their quoted forms instead
+		diff(fmt.Sprintf("MultiValueHeaders[%q]", k),
+			fmt.Sprintf("%q", a.MultiValueHeaders[k]),
+			fmt.Sprintf("%q", b.MultiValueHeaders[k]))
+	}
+	diff("Body", a.Body, b.Body)
+	diff("IsBase64Encoded", a.IsBase64Encoded, b.IsBase64Encoded)
+
+	return sb.String()
+}
+
+// sortedKeys returns the keys of the set in order
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
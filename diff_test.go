@@ -0,0 +1,37 @@
+package awseventadapter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffResponses(t *testing.T) {
+	a := &AdapterResponse{
+		StatusCode:        200,
+		Headers:           map[string]string{"Content-Type": "text/plain"},
+		MultiValueHeaders: map[string][]string{"Content-Type": {"text/plain"}},
+		Body:              "ok",
+	}
+	if got := DiffResponses(a, a); got != "" {
+		t.Errorf("DiffResponses of equal responses = %q, want empty", got)
+	}
+
+	b := &AdapterResponse{
+		StatusCode:        404,
+		Headers:           map[string]string{"Content-Type": "application/json"},
+		MultiValueHeaders: map[string][]string{"Content-Type": {"application/json"}},
+		Body:              "ok",
+	}
+	got := DiffResponses(a, b)
+	for _, want := range []string{
+		"- StatusCode: 200\n+ StatusCode: 404\n",
+		"- Headers[\"Content-Type\"]: \"text/plain\"\n+ Headers[\"Content-Type\"]: \"application/json\"\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("DiffResponses() = %q, missing %q", got, want)
+		}
+	}
+	if strings.Contains(got, "Body") {
+		t.Errorf("DiffResponses() = %q, reports the matching body", got)
+	}
+}
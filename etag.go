@@ -0,0 +1,53 @@
+package awseventadapter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// setETag gives successful GET responses, and HEAD responses carrying a body,
+// without an ETag one built from a hash of the body, then reports whether the request's If-None-Match
+// matches the response's ETag so a 304 can be returned instead
+func setETag(r *http.Response, statusCode int, body []byte, weak bool) bool {
+	if r.Request == nil || statusCode != http.StatusOK {
+		return false
+	}
+	if r.Request.Method != http.MethodGet && r.Request.Method != http.MethodHead {
+		return false
+	}
+
+	etag := r.Header.Get("ETag")
+	if etag == "" && r.Request.Method == http.MethodHead && len(body) == 0 {
+		// HEAD responses normally have no body, its hash wouldn't match the
+		// ETag of the same resource on a GET
+		return false
+	}
+	if etag == "" {
+		sum := sha256.Sum256(body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		if weak {
+			etag = "W/" + etag
+		}
+		r.Header.Set("ETag", etag)
+	}
+
+	return etagMatches(r.Request.Header.Get("If-None-Match"), etag)
+}
+
+// etagMatches does the weak comparison If-None-Match calls for
+// https://tools.ietf.org/html/rfc7232#section-3.2
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package awseventadapter
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAutoETag(t *testing.T) {
+	opts := &AdapterOptions{AutoETag: true}
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(opts)
+	resp := serve(t, ar, respond("text/plain", "cacheable"))
+	etag := resp.Headers["Etag"]
+	if etag == "" || etag[0] != '"' {
+		t.Fatalf("ETag = %q, want a strong ETag", etag)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"If-None-Match": etag}}
+	ar.SetOptions(opts)
+	resp = serve(t, ar, respond("text/plain", "cacheable"))
+	if resp.StatusCode != http.StatusNotModified || resp.Body != "" {
+		t.Errorf("Matching If-None-Match gave %d %q, want an empty 304", resp.StatusCode, resp.Body)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/", Headers: map[string]string{"If-None-Match": `"stale"`}}
+	ar.SetOptions(opts)
+	if resp = serve(t, ar, respond("text/plain", "cacheable")); resp.StatusCode != http.StatusOK {
+		t.Errorf("Stale If-None-Match gave %d, want 200", resp.StatusCode)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{AutoETag: true, WeakETag: true})
+	if etag := serve(t, ar, respond("text/plain", "cacheable")).Headers["Etag"]; etag[:2] != "W/" {
+		t.Errorf("ETag with WeakETag = %q, want a weak ETag", etag)
+	}
+}
+
+func TestAutoETagHead(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "HEAD", Path: "/"}
+	ar.SetOptions(&AdapterOptions{AutoETag: true})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+	})
+	if etag, ok := serve(t, ar, h).Headers["Etag"]; ok {
+		t.Errorf("ETag = %q on a HEAD without a body, want none", etag)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "HEAD", Path: "/"}
+	ar.SetOptions(&AdapterOptions{AutoETag: true})
+	head := serve(t, ar, respond("text/plain", "cacheable")).Headers["Etag"]
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{AutoETag: true})
+	if get := serve(t, ar, respond("text/plain", "cacheable")).Headers["Etag"]; head != get {
+		t.Errorf("HEAD ETag = %q with the body written, want the GET's %q", head, get)
+	}
+}
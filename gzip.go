@@ -0,0 +1,127 @@
+package awseventadapter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultGzipMinSize is the smallest body GzipResponses compresses when
+// GzipMinSize isn't set, below it the gzip overhead eats the savings
+const defaultGzipMinSize = 1024
+
+// incompressibleContentTypes are already compressed, gzipping them again only
+// costs time. Entries ending in / are matched as a prefix.
+var incompressibleContentTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"image/webp",
+	"audio/",
+	"video/",
+	"font/woff",
+	"font/woff2",
+}
+
+// gzipBody compresses the body when the GzipResponses option is on, the body
+// is big enough and not already compressed, and the request accepts gzip. It
+// sets Content-Encoding and Vary: Accept-Encoding, and reports whether it
+// compressed anything so the body gets base64 encoded.
+func gzipBody(r *http.Response, statusCode int, body []byte, opts *AdapterOptions) ([]byte, bool, error) {
+	minSize := opts.GzipMinSize
+	if minSize <= 0 {
+		minSize = defaultGzipMinSize
+	}
+	switch {
+	case !opts.GzipResponses || r.Request == nil || len(body) < minSize,
+		// A partial body can't be compressed without breaking Content-Range
+		statusCode == http.StatusPartialContent,
+		r.Header.Get("Content-Encoding") != "",
+		isBinaryContentType(r.Header.Get(contentTypeHeaderKey), incompressibleContentTypes):
+		return body, false, nil
+	}
+
+	// Caches have to know the response depends on Accept-Encoding whether or
+	// not this client gets it compressed
+	addVary(r.Header, "Accept-Encoding")
+	if !acceptsGzip(r.Request.Header.Get("Accept-Encoding")) {
+		return body, false, nil
+	}
+
+	level := opts.GzipLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var b bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := zw.Write(body); err != nil {
+		return nil, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false, err
+	}
+
+	r.Header.Set("Content-Encoding", "gzip")
+	if r.Header.Get("Content-Length") != "" {
+		r.Header.Set("Content-Length", strconv.Itoa(b.Len()))
+	}
+	// The compressed bytes differ from the ones a strong ETag vouches for
+	if etag := r.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		r.Header.Set("ETag", "W/"+etag)
+	}
+	return b.Bytes(), true, nil
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip with a q
+// value above zero, naming gzip wins over *
+func acceptsGzip(acceptEncoding string) bool {
+	gzipOK, starOK := false, false
+	named := false
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		accepted := true
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		if name == "gzip" {
+			gzipOK, named = accepted, true
+		} else {
+			starOK = accepted
+		}
+	}
+	if named {
+		return gzipOK
+	}
+	return starOK
+}
+
+// addVary adds a header name to Vary unless it's already listed
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, existing := range strings.Split(v, ",") {
+			existing = strings.TrimSpace(existing)
+			if existing == "*" || strings.EqualFold(existing, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
@@ -0,0 +1,134 @@
+package awseventadapter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gzipRequest returns a GET accepting gzip with the GzipResponses option set
+func gzipRequest(opts AdapterOptions) *AdapterRequest {
+	opts.GzipResponses = true
+	ar := &AdapterRequest{
+		HTTPMethod: "GET",
+		Path:       "/",
+		Headers:    map[string]string{"Accept-Encoding": "gzip, deflate"},
+	}
+	ar.SetOptions(&opts)
+	return ar
+}
+
+func TestGzipSetsVary(t *testing.T) {
+	body := strings.Repeat("compress me ", 1000)
+	resp := serve(t, gzipRequest(AdapterOptions{}), respond("text/plain", body))
+	if resp.Headers["Content-Encoding"] != "gzip" {
+		t.Fatalf("Response wasn't gzipped: %v", resp.Headers)
+	}
+	if got := resp.MultiValueHeaders["Vary"]; len(got) != 1 || got[0] != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want [Accept-Encoding]", got)
+	}
+
+	// A Vary the handler set already is kept and not repeated
+	resp = serve(t, gzipRequest(AdapterOptions{}), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Origin, accept-encoding")
+		respond("text/plain", body)(w, r)
+	})
+	if got := resp.MultiValueHeaders["Vary"]; len(got) != 1 || got[0] != "Origin, accept-encoding" {
+		t.Errorf("Vary = %q, want the handler's only", got)
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	// Varied enough text that the levels don't all find the same matches
+	var b strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&b, "item %d costs %d, ", i, i*i%977)
+	}
+	body := b.String()
+
+	sizes := map[int]int{}
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		resp := serve(t, gzipRequest(AdapterOptions{GzipLevel: level}), respond("text/plain", body))
+		if resp.Headers["Content-Encoding"] != "gzip" {
+			t.Fatalf("Level %d: response wasn't gzipped", level)
+		}
+		sizes[level] = len(resp.Body)
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("BestCompression gave %d bytes, BestSpeed %d, want it smaller", sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+
+	if _, err := gzipRequest(AdapterOptions{GzipLevel: 42}).Proxy(context.Background(), respond("text/plain", body)); err == nil {
+		t.Error("Proxy() with an invalid GzipLevel didn't fail")
+	}
+}
+
+func TestGzipMinSize(t *testing.T) {
+	small := serve(t, gzipRequest(AdapterOptions{}), respond("text/plain", "0123456789"))
+	if small.Headers["Content-Encoding"] != "" || small.Body != "0123456789" {
+		t.Errorf("10 byte body was gzipped: %v %q", small.Headers, small.Body)
+	}
+	large := serve(t, gzipRequest(AdapterOptions{}), respond("text/plain", strings.Repeat("x", 10*1024)))
+	if large.Headers["Content-Encoding"] != "gzip" || !large.IsBase64Encoded {
+		t.Errorf("10KB body wasn't gzipped: %v", large.Headers)
+	}
+
+	small = serve(t, gzipRequest(AdapterOptions{GzipMinSize: 5}), respond("text/plain", "0123456789"))
+	if small.Headers["Content-Encoding"] != "gzip" {
+		t.Errorf("10 byte body wasn't gzipped with a GzipMinSize of 5")
+	}
+}
+
+func TestGzipLargeTextBody(t *testing.T) {
+	body := strings.Repeat(`{"id": 1, "name": "item"},`, 1000)
+	resp := serve(t, gzipRequest(AdapterOptions{}), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	})
+	if !resp.IsBase64Encoded || resp.Headers["Content-Encoding"] != "gzip" {
+		t.Fatalf("Response = base64 %v with %v, want gzip and base64", resp.IsBase64Encoded, resp.Headers)
+	}
+	compressed, err := base64.StdEncoding.DecodeString(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(zr); err != nil || string(b) != body {
+		t.Errorf("Body doesn't gunzip to the handler's: %v", err)
+	}
+	if got := resp.Headers["Content-Length"]; got != strconv.Itoa(len(compressed)) {
+		t.Errorf("Content-Length = %s, want the compressed %d", got, len(compressed))
+	}
+	if got := resp.Headers["Etag"]; got != `W/"v1"` {
+		t.Errorf("ETag = %s, want it weakened", got)
+	}
+	if got := resp.Headers["Content-Type"]; got != "application/json" {
+		t.Errorf("Content-Type = %q, want it kept", got)
+	}
+	if got := string(resp.RawBody()); got != body {
+		t.Errorf("RawBody() returned %d bytes, want the %d uncompressed ones", len(got), len(body))
+	}
+
+	// Already compressed types and clients not accepting gzip are left alone
+	resp = serve(t, gzipRequest(AdapterOptions{}), respond("image/png", body))
+	if resp.Headers["Content-Encoding"] != "" {
+		t.Error("image/png was gzipped")
+	}
+	ar := gzipRequest(AdapterOptions{})
+	ar.Headers["Accept-Encoding"] = "gzip;q=0, identity"
+	if resp = serve(t, ar, respond("text/plain", body)); resp.Headers["Content-Encoding"] != "" || resp.Body != body {
+		t.Error("Response was gzipped for a client refusing gzip")
+	}
+}
@@ -0,0 +1,392 @@
+package awseventadapter
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AdapterOptions holds the optional behavior of the adapter. The zero value
+// keeps the default behavior, attach it to a request with
+// AdapterRequest.SetOptions before calling Proxy or ToRequest.
+type AdapterOptions struct {
+	// StripQueryParameters lists query parameter names that are dropped before
+	// the request reaches the handler, e.g. tracking tokens
+	StripQueryParameters []string
+
+	// InjectStage puts the `requestContext.stage` on the handler's request
+	// context, read it back with StageFromContext
+	InjectStage bool
+
+	// LenientBase64 only base64 encodes response bodies that aren't valid utf8
+	// or have one of the BinaryContentTypes. By default any content type that
+	// isn't known to be text is encoded.
+	LenientBase64 bool
+
+	// BinaryContentTypes are response content types that are always base64
+	// encoded, even when the body is valid utf8. Entries ending in / match
+	// every subtype, e.g. "image/", apart from +xml and +json ones like
+	// image/svg+xml, list those in full to encode them. Nil uses a default
+	// list covering PDFs, archives, application/octet-stream and image, audio,
+	// video and font types.
+	BinaryContentTypes []string
+
+	// ExpectedSource forces the event to be treated as coming from a specific
+	// service, for events that don't carry enough to tell. See
+	// AdapterRequest.Source.
+	ExpectedSource EventSource
+
+	// ContextHeaders maps request header names to context keys. The header
+	// values are put on the handler's request context, read them back with
+	// ContextValue.
+	ContextHeaders map[string]string
+
+	// PreEncodedQuery treats query parameter names and values as already URL
+	// encoded, so they aren't escaped a second time (%20 staying %20 rather
+	// than becoming %2520)
+	PreEncodedQuery bool
+
+	// DefaultUserAgent is set as the request's User-Agent when the event
+	// doesn't carry one
+	DefaultUserAgent string
+
+	// ForwardedFor sets X-Forwarded-For to the client IP from the request
+	// context when the event doesn't carry the header, for frameworks that
+	// take the client IP from it
+	ForwardedFor bool
+
+	// TrustForwardedHost takes r.Host from X-Forwarded-Host over the event's
+	// Host header. Neither API Gateway nor an ALB sets it, so only turn it on
+	// behind a proxy that does and strips it from clients, otherwise a client
+	// picks the host links are built from.
+	TrustForwardedHost bool
+
+	// DecompressRequests gunzips request bodies sent with Content-Encoding:
+	// gzip before the handler sees them, dropping the header. A body that
+	// doesn't decompress, or decompresses past MaxDecompressedSize, fails with
+	// ErrInvalidGzipBody.
+	DecompressRequests bool
+
+	// MaxDecompressedSize caps how many bytes DecompressRequests unpacks a
+	// body to, so a small body can't expand until the invocation runs out of
+	// memory. Zero means 32MB.
+	MaxDecompressedSize int64
+
+	// StreamBodyThreshold is the size of a base64 encoded body, in bytes, above
+	// which it's decoded as the handler reads it rather than all at once. Zero
+	// always decodes up front.
+	StreamBodyThreshold int
+
+	// MapStatus rewrites the handler's status code before it's returned, e.g.
+	// to turn a 418 into a 400
+	MapStatus func(statusCode int) int
+
+	// EmptyBodyDefaults maps status codes to a body returned in place of an
+	// empty one, e.g. {http.StatusOK: "{}"} for clients that choke on empty
+	// 200s. Status codes are matched after MapStatus.
+	EmptyBodyDefaults map[int]string
+
+	// SingleValueHeaders are response headers that only keep their first value
+	// if the handler sets them more than once. Nil uses Content-Type,
+	// Content-Length, Content-Range and Location, an empty slice turns this
+	// off.
+	SingleValueHeaders []string
+
+	// AutoETag sets an ETag on successful GET responses that lack one, using a
+	// hash of the body, and answers a matching If-None-Match with a 304. HEAD
+	// responses only get one when the handler wrote the body, an empty body
+	// would hash to an ETag that never matches the GET's.
+	AutoETag bool
+
+	// WeakETag makes the ETags set by AutoETag weak validators
+	WeakETag bool
+
+	// RejectEmptyPath makes ToRequest fail with ErrEmptyPath for events
+	// without a path, rather than treating them as a request for /
+	RejectEmptyPath bool
+
+	// RequestErrorResponses makes Proxy answer events that can't be turned into
+	// an http.Request, e.g. a body that isn't valid base64, with a JSON 400
+	// rather than returning an error and failing the invocation
+	RequestErrorResponses bool
+
+	// JoinQueryValues collapses multi value query parameters into a single
+	// value joined with this separator, a=1&a=2 becomes a=1,2 with ",". Empty
+	// repeats the parameter for each value.
+	JoinQueryValues string
+
+	// PlusAsSpace decodes + in query parameters as a space, the way HTML forms
+	// encode them. By default a + is a literal plus, matching the decoded
+	// values API Gateway delivers. The v2 RawQueryString is the exception, it's
+	// passed on encoded as the client sent it and a + in it is always a space,
+	// whatever this is set to.
+	PlusAsSpace bool
+
+	// Ready gates requests during a warmup, until it returns true Proxy
+	// answers with a 503 and a Retry-After header without calling the handler
+	Ready func() bool
+
+	// RetryAfter is sent in the Retry-After header while Ready returns false,
+	// rounded up to whole seconds. Defaults to one second.
+	RetryAfter time.Duration
+
+	// ResponseHeaders are added to every response the handler didn't set them
+	// on, e.g. Strict-Transport-Security or X-Content-Type-Options
+	ResponseHeaders http.Header
+
+	// BasePathExempt lists path.Match patterns, e.g. "/v1/health" or
+	// "/v1/status/*", for paths that keep their base path when StripBasePath
+	// is in use. Patterns are matched against the path from the event.
+	BasePathExempt []string
+
+	// EnsureCharset appends charset=utf-8 to text/* response content types
+	// that don't name a charset, as long as the body is valid utf8
+	EnsureCharset bool
+
+	// StrictNoContent fails the response with ErrBodyNotAllowed when the
+	// handler writes a body with a 204, which is handy in tests. By default the
+	// body is dropped.
+	StrictNoContent bool
+
+	// DetectJSON sets Content-Type: application/json on responses that are
+	// valid JSON when the handler didn't set a content type itself
+	DetectJSON bool
+
+	// DisableSniffing stops the adapter guessing a Content-Type with
+	// http.DetectContentType when the handler didn't set one, the response
+	// goes out without one instead. DetectJSON still applies.
+	DisableSniffing bool
+
+	// CorrelationHeader names a header, e.g. X-Correlation-Id, carrying a
+	// correlation id. An id is generated when the request doesn't have one, it
+	// reaches the handler in the header and via CorrelationIDFromContext, and
+	// is echoed on the response unless the handler set the header itself,
+	// including the error responses the adapter builds.
+	CorrelationHeader string
+
+	// RouteTimeouts maps path.Match patterns, e.g. "/reports/*", to how long
+	// the handler gets for matching requests before Proxy gives up on it and
+	// returns a 504. When several patterns match the shortest timeout wins.
+	RouteTimeouts map[string]time.Duration
+
+	// TransformBody post-processes response bodies, e.g. to minify or redact
+	// them. It gets the response's content type and runs before the ETag and
+	// base64 decisions are made.
+	TransformBody func(contentType string, body []byte) []byte
+
+	// PropagatePanics lets a panic in the handler escape Proxy. By default it's
+	// recovered and logged with its stack, and Proxy returns a 500 like
+	// net/http's server would. With this set the panic is raised again from
+	// Proxy, on the caller's goroutine even when the handler ran on its own
+	// under a timeout, with the original value but not the handler's stack.
+	// A handler abandoned after a timeout can't propagate a later panic, it's
+	// dropped.
+	PropagatePanics bool
+
+	// RewriteLocation points a Location header built from the request URL back
+	// at the domain the client called. Handlers only see the fake server
+	// address, so absolute redirects would otherwise send clients there.
+	RewriteLocation bool
+
+	// Timeout is how long the handler gets for requests no RouteTimeouts
+	// pattern matches, after which Proxy logs it and returns a 504. Zero
+	// leaves them to the invocation deadline.
+	Timeout time.Duration
+
+	// DeadlineMargin is how long before the invocation deadline on Proxy's
+	// context the handler is given up on with a 504, leaving time to send it
+	// before Lambda stops the invocation. The handler's request context is
+	// done at that point too. Defaults to 100ms.
+	DeadlineMargin time.Duration
+
+	// ErrorEnvelope shapes the JSON body of the responses Proxy builds itself,
+	// like the 504 after a timeout. It maps field names to templates where
+	// "{code}", "{message}" and "{requestId}" get filled in, e.g.
+	// {"error": "{message}", "status": "{code}", "requestId": "{requestId}"}.
+	// By default the body is {"message": "..."}.
+	ErrorEnvelope map[string]string
+
+	// MaxResponseHeaderCount fails the response with ErrTooManyHeaders when it
+	// carries more header values than this, so going over API Gateway's limit
+	// shows up as a clear error rather than an opaque one from the gateway.
+	// Zero means no limit.
+	MaxResponseHeaderCount int
+
+	// ServerAddress replaces the scheme and host ToRequest puts in front of the
+	// path, e.g. http://my-custom.host.com, for this adapter only. It wins over
+	// the CustomHostVariable, which wins over DefaultServerAddress.
+	ServerAddress string
+
+	// Capture is called with the event and the response of every invocation
+	// Proxy answers, including the error responses it builds itself, e.g. to
+	// save them somewhere for replaying later. It runs before Proxy returns,
+	// so keep it quick or hand the work off.
+	Capture func(req *AdapterRequest, resp *AdapterResponse)
+
+	// GzipResponses gzips response bodies of at least GzipMinSize bytes when
+	// the request's Accept-Encoding allows it, setting Content-Encoding and
+	// Vary: Accept-Encoding. The compressed body is always base64 encoded.
+	// Bodies already compressed by the handler or with an already compressed
+	// content type, e.g. image/png, are left alone.
+	GzipResponses bool
+
+	// GzipMinSize is the smallest body GzipResponses compresses, 1024 bytes
+	// when zero. Below about that the gzip overhead outweighs the savings.
+	GzipMinSize int
+
+	// GzipLevel is the compress/gzip level GzipResponses uses, from
+	// gzip.BestSpeed to gzip.BestCompression. Zero means
+	// gzip.DefaultCompression.
+	GzipLevel int
+
+	// MaxResponseSize fails responses whose body, after any base64 encoding,
+	// is longer than this many bytes with ErrResponseTooLarge. Lambda rejects
+	// synchronous responses over 6MB with an unhelpful error, leave some room
+	// for the headers and JSON around the body. Zero means no limit.
+	MaxResponseSize int
+
+	// ResponseTooLargeResponses makes Proxy answer a response over
+	// MaxResponseSize with a JSON 413 rather than returning
+	// ErrResponseTooLarge and failing the invocation
+	ResponseTooLargeResponses bool
+
+	// CORSOrigins lists the origins allowed to make cross origin requests.
+	// "*" allows any origin, "https://*.example.com" any subdomain of
+	// example.com, other entries have to match the Origin exactly. Allowed
+	// origins get Access-Control-Allow-Origin on the response unless the
+	// handler set it, and their preflight OPTIONS requests are answered with a
+	// 204 without calling the handler. Requests from other origins go through
+	// untouched.
+	CORSOrigins []string
+
+	// CORSOriginPatterns are regular expressions allowing the origins they
+	// match, alongside CORSOrigins. Anchor them with ^ and $, an unanchored
+	// pattern matches anywhere in the Origin.
+	CORSOriginPatterns []*regexp.Regexp
+}
+
+// SetOptions attaches options to the request. The same options can be shared
+// between requests, they aren't modified by the adapter.
+func (ar *AdapterRequest) SetOptions(opts *AdapterOptions) {
+	ar.options = opts
+}
+
+// opts returns the attached options, or the defaults when none are set
+func (ar *AdapterRequest) opts() *AdapterOptions {
+	if ar.options == nil {
+		return &AdapterOptions{}
+	}
+	return ar.options
+}
+
+// stripQueryParameter reports whether the query parameter should be dropped
+func (o *AdapterOptions) stripQueryParameter(name string) bool {
+	for _, n := range o.StripQueryParameters {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// basePathExempt reports whether the path keeps its base path
+func (o *AdapterOptions) basePathExempt(p string) bool {
+	for _, pattern := range o.BasePathExempt {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTimeout returns the timeout for the request path, falling back to
+// Timeout when no pattern matches
+func (o *AdapterOptions) routeTimeout(p string) time.Duration {
+	var timeout time.Duration
+	for pattern, t := range o.RouteTimeouts {
+		if ok, _ := path.Match(pattern, p); ok && (timeout == 0 || t < timeout) {
+			timeout = t
+		}
+	}
+	if timeout == 0 {
+		return o.Timeout
+	}
+	return timeout
+}
+
+// deadlineMargin returns the DeadlineMargin, or the default when it isn't set
+func (o *AdapterOptions) deadlineMargin() time.Duration {
+	if o.DeadlineMargin <= 0 {
+		return defaultDeadlineMargin
+	}
+	return o.DeadlineMargin
+}
+
+// maxDecompressedSize returns the MaxDecompressedSize, or the default when it
+// isn't set
+func (o *AdapterOptions) maxDecompressedSize() int64 {
+	if o.MaxDecompressedSize <= 0 {
+		return defaultMaxDecompressedSize
+	}
+	return o.MaxDecompressedSize
+}
+
+// stripRawQuery drops the StripQueryParameters from an encoded query string,
+// leaving everything else exactly as it was
+func (o *AdapterOptions) stripRawQuery(raw string) string {
+	if len(o.StripQueryParameters) == 0 {
+		return raw
+	}
+	var kept []string
+	for _, pair := range strings.Split(raw, "&") {
+		name := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			name = pair[:i]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if !o.stripQueryParameter(name) {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// escapeQuery encodes a query parameter name or value from the event for the
+// request URL
+func (o *AdapterOptions) escapeQuery(s string) string {
+	if o.PreEncodedQuery {
+		if !o.PlusAsSpace {
+			s = strings.Replace(s, "+", "%2B", -1)
+		}
+		return s
+	}
+	if o.PlusAsSpace {
+		s = strings.Replace(s, "+", " ", -1)
+	}
+	return url.QueryEscape(s)
+}
+
+// unescapeQuery decodes a query parameter name or value from the event the
+// same way the handler will see it. Anything that fails to decode is returned
+// as is.
+func (o *AdapterOptions) unescapeQuery(s string) string {
+	if !o.PreEncodedQuery {
+		if o.PlusAsSpace {
+			s = strings.Replace(s, "+", " ", -1)
+		}
+		return s
+	}
+	unescape := url.PathUnescape
+	if o.PlusAsSpace {
+		unescape = url.QueryUnescape
+	}
+	if d, err := unescape(s); err == nil {
+		return d
+	}
+	return s
+}
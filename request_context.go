@@ -0,0 +1,243 @@
+package awseventadapter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+// requestContextMap returns the RequestContext as a generic map. The lambda
+// runtime hands us a map already when it unmarshals the event, but a caller
+// building an AdapterRequest by hand may have used one of the events context
+// structs, so round trip anything else through JSON.
+func (ar *AdapterRequest) requestContextMap() map[string]interface{} {
+	switch rc := ar.RequestContext.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		return rc
+	}
+
+	b, err := json.Marshal(ar.RequestContext)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// requestContextValue walks the RequestContext following keys and returns
+// whatever is found at the end, or nil if any part of the path is missing
+func (ar *AdapterRequest) requestContextValue(keys ...string) interface{} {
+	var v interface{} = ar.requestContextMap()
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// decodeRequestContext unmarshals the part of the RequestContext found by
+// following keys into v
+func (ar *AdapterRequest) decodeRequestContext(v interface{}, keys ...string) error {
+	value := ar.requestContextValue(keys...)
+	if value == nil {
+		return errors.Errorf("Request context has no %s", strings.Join(keys, "."))
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal request context")
+	}
+	return errors.Wrap(json.Unmarshal(b, v), "Unable to unmarshal request context")
+}
+
+// requestContextString is requestContextValue for string fields, returning ""
+// when the field is missing or isn't a string
+func (ar *AdapterRequest) requestContextString(keys ...string) string {
+	s, _ := ar.requestContextValue(keys...).(string)
+	return s
+}
+
+// ContextHTTPMethod returns the `requestContext.httpMethod` of a v1 event. This
+// normally matches HTTPMethod, some frameworks like to double check it.
+func (ar *AdapterRequest) ContextHTTPMethod() string {
+	return ar.requestContextString("httpMethod")
+}
+
+// Stage returns the `requestContext.stage` the request was deployed to, handy
+// for driving per stage config
+func (ar *AdapterRequest) Stage() string {
+	return ar.requestContextString("stage")
+}
+
+// Caller returns the IAM caller from `requestContext.identity.caller`
+func (ar *AdapterRequest) Caller() string {
+	return ar.requestContextString("identity", "caller")
+}
+
+// ResourcePath returns the `requestContext.resourcePath` of a v1 event, the
+// resource template the request matched
+func (ar *AdapterRequest) ResourcePath() string {
+	return ar.requestContextString("resourcePath")
+}
+
+// RequestTime returns the formatted `requestContext.requestTime` string, e.g.
+// "09/Apr/2015:12:34:56 +0000"
+func (ar *AdapterRequest) RequestTime() string {
+	return ar.requestContextString("requestTime")
+}
+
+// PrincipalID returns the `principalId` set by a lambda authorizer. v1 events
+// carry it in `requestContext.authorizer`, v2 events nest the authorizer's
+// context under `requestContext.authorizer.lambda`.
+func (ar *AdapterRequest) PrincipalID() string {
+	if id := ar.requestContextString("authorizer", "principalId"); id != "" {
+		return id
+	}
+	return ar.requestContextString("authorizer", "lambda", "principalId")
+}
+
+// SourceIP returns the `requestContext.identity.sourceIp` recorded by API
+// Gateway. Unlike X-Forwarded-For this can't be set by the client.
+func (ar *AdapterRequest) SourceIP() string {
+	return ar.requestContextString("identity", "sourceIp")
+}
+
+// ELBContext returns the `requestContext.elb` block of an ALB event, which
+// carries the target group ARN
+func (ar *AdapterRequest) ELBContext() (events.ELBContext, error) {
+	var elb events.ELBContext
+	err := ar.decodeRequestContext(&elb, "elb")
+	return elb, err
+}
+
+// Identity returns the `requestContext.identity` block of a v1 event, with the
+// caller's IP, user agent and IAM or Cognito details
+func (ar *AdapterRequest) Identity() (events.APIGatewayRequestIdentity, error) {
+	var identity events.APIGatewayRequestIdentity
+	err := ar.decodeRequestContext(&identity, "identity")
+	return identity, err
+}
+
+// V2ClientCert returns the mTLS client certificate of a v2 event from
+// `requestContext.authentication.clientCert`, v1 events keep theirs in the
+// identity block instead
+func (ar *AdapterRequest) V2ClientCert() (events.APIGatewayV2HTTPRequestContextAuthenticationClientCert, error) {
+	var clientCert events.APIGatewayV2HTTPRequestContextAuthenticationClientCert
+	err := ar.decodeRequestContext(&clientCert, "authentication", "clientCert")
+	return clientCert, err
+}
+
+// Protocol returns the `requestContext.protocol` of a v1 event, e.g. HTTP/1.1
+func (ar *AdapterRequest) Protocol() string {
+	return ar.requestContextString("protocol")
+}
+
+// TimeEpoch returns the `requestContext.timeEpoch` of a v2 event, the time the
+// request was received. It's the zero time if the event doesn't have one.
+func (ar *AdapterRequest) TimeEpoch() time.Time {
+	ms, ok := ar.requestContextValue("timeEpoch").(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// APIID returns the `requestContext.apiId` of the API Gateway API that
+// received the request, the key is the same in v1 and v2 events
+func (ar *AdapterRequest) APIID() string {
+	return ar.requestContextString("apiId")
+}
+
+// User returns the IAM user from `requestContext.identity.user`
+func (ar *AdapterRequest) User() string {
+	return ar.requestContextString("identity", "user")
+}
+
+// DomainName returns the `requestContext.domainName` the client called, for
+// building absolute URLs. The key is the same in v1 and v2 events.
+func (ar *AdapterRequest) DomainName() string {
+	return ar.requestContextString("domainName")
+}
+
+// ContextPath returns the path recorded in the request context, from
+// `requestContext.http.path` in v2 events or `requestContext.path` in v1
+// events. It can include the stage and differ from the top level `path` or v2
+// `rawPath`, which routes are matched against, so ToRequest only falls back to
+// it for events without either.
+func (ar *AdapterRequest) ContextPath() string {
+	if p := ar.requestContextString("http", "path"); p != "" {
+		return p
+	}
+	return ar.requestContextString("path")
+}
+
+// CognitoAuthenticationProvider returns the
+// `requestContext.identity.cognitoAuthenticationProvider` string of a Cognito
+// authenticated request, which ends with the user pool and subject
+func (ar *AdapterRequest) CognitoAuthenticationProvider() string {
+	return ar.requestContextString("identity", "cognitoAuthenticationProvider")
+}
+
+// RouteKey returns the `requestContext.routeKey` of a v2 event split into its
+// method and path, "GET /items/{id}" gives "GET" and "/items/{id}". Route keys
+// without a method, like "$default", come back as the path.
+func (ar *AdapterRequest) RouteKey() (method, path string) {
+	routeKey := ar.requestContextString("routeKey")
+	if i := strings.Index(routeKey, " "); i >= 0 {
+		return routeKey[:i], routeKey[i+1:]
+	}
+	return "", routeKey
+}
+
+// GetAPIGatewayContext returns the API Gateway request context ToRequest stored
+// in the APIGwContextHeader, use it from a handler to get at the account,
+// request id and identity of the request
+func GetAPIGatewayContext(r *http.Request) (events.APIGatewayProxyRequestContext, error) {
+	var requestContext events.APIGatewayProxyRequestContext
+	header := r.Header.Get(APIGwContextHeader)
+	if header == "" {
+		return requestContext, errors.New("No API Gateway context header in the request")
+	}
+	if err := json.Unmarshal([]byte(header), &requestContext); err != nil {
+		return requestContext, errors.Wrap(err, "Unable to unmarshal API Gateway context")
+	}
+	return requestContext, nil
+}
+
+// GetAPIGatewayStageVars returns the stage variables ToRequest stored in the
+// APIGwStageVarsHeader, an empty map when the stage has none
+func GetAPIGatewayStageVars(r *http.Request) (map[string]string, error) {
+	stageVars := map[string]string{}
+	header := r.Header.Get(APIGwStageVarsHeader)
+	if header == "" {
+		return stageVars, errors.New("No API Gateway stage variables header in the request")
+	}
+	if err := json.Unmarshal([]byte(header), &stageVars); err != nil {
+		return stageVars, errors.Wrap(err, "Unable to unmarshal API Gateway stage variables")
+	}
+	return stageVars, nil
+}
+
+// AccountID returns the top level `requestContext.accountId`, the AWS account
+// that owns the API
+func (ar *AdapterRequest) AccountID() string {
+	return ar.requestContextString("accountId")
+}
+
+// IdentityAccountID returns `requestContext.identity.accountId`, the AWS
+// account of the caller. It's only set for IAM authorized requests and can
+// differ from AccountID for cross account callers.
+func (ar *AdapterRequest) IdentityAccountID() string {
+	return ar.requestContextString("identity", "accountId")
+}
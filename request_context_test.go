@@ -0,0 +1,251 @@
+package awseventadapter
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// eventWithContext unmarshals a request context the way the lambda runtime
+// hands it over
+func eventWithContext(t *testing.T, requestContext string) *AdapterRequest {
+	t.Helper()
+	ar := &AdapterRequest{}
+	if err := json.Unmarshal([]byte(`{"requestContext": `+requestContext+`}`), ar); err != nil {
+		t.Fatalf("Unable to unmarshal event: %v", err)
+	}
+	return ar
+}
+
+func TestContextHTTPMethod(t *testing.T) {
+	ar := eventWithContext(t, `{"httpMethod": "POST"}`)
+	ar.HTTPMethod = "POST"
+	if got := ar.ContextHTTPMethod(); got != ar.HTTPMethod {
+		t.Errorf("ContextHTTPMethod() = %q, want %q", got, ar.HTTPMethod)
+	}
+	if got := (&AdapterRequest{}).ContextHTTPMethod(); got != "" {
+		t.Errorf("ContextHTTPMethod() without a context = %q, want empty", got)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	ar := eventWithContext(t, `{"identity": {"caller": "AROAEXAMPLE:session"}}`)
+	if got := ar.Caller(); got != "AROAEXAMPLE:session" {
+		t.Errorf("Caller() = %q, want %q", got, "AROAEXAMPLE:session")
+	}
+}
+
+func TestResourcePath(t *testing.T) {
+	ar := eventWithContext(t, `{"resourcePath": "/items/{id}"}`)
+	if got := ar.ResourcePath(); got != "/items/{id}" {
+		t.Errorf("ResourcePath() = %q, want %q", got, "/items/{id}")
+	}
+}
+
+func TestRequestTime(t *testing.T) {
+	ar := eventWithContext(t, `{"requestTime": "09/Apr/2015:12:34:56 +0000"}`)
+	if got := ar.RequestTime(); got != "09/Apr/2015:12:34:56 +0000" {
+		t.Errorf("RequestTime() = %q", got)
+	}
+	if got := (&AdapterRequest{}).RequestTime(); got != "" {
+		t.Errorf("RequestTime() without a request context = %q, want empty", got)
+	}
+}
+
+func TestPrincipalID(t *testing.T) {
+	for name, requestContext := range map[string]string{
+		"v1": `{"authorizer": {"principalId": "user-1"}}`,
+		"v2": `{"authorizer": {"lambda": {"principalId": "user-1"}}}`,
+	} {
+		if got := eventWithContext(t, requestContext).PrincipalID(); got != "user-1" {
+			t.Errorf("%s: PrincipalID() = %q, want %q", name, got, "user-1")
+		}
+	}
+}
+
+func TestSourceIP(t *testing.T) {
+	ar := eventWithContext(t, `{"identity": {"sourceIp": "203.0.113.7"}}`)
+	ar.Headers = map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"}
+	if got := ar.SourceIP(); got != "203.0.113.7" {
+		t.Errorf("SourceIP() = %q, want the gateway recorded IP", got)
+	}
+}
+
+func TestELBContext(t *testing.T) {
+	const arn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/lambda/abc123"
+	elb, err := eventWithContext(t, `{"elb": {"targetGroupArn": "`+arn+`"}}`).ELBContext()
+	if err != nil {
+		t.Fatalf("ELBContext: %v", err)
+	}
+	if elb.TargetGroupArn != arn {
+		t.Errorf("TargetGroupArn = %q, want %q", elb.TargetGroupArn, arn)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	if got := eventWithContext(t, `{"protocol": "HTTP/1.1"}`).Protocol(); got != "HTTP/1.1" {
+		t.Errorf("Protocol() = %q, want %q", got, "HTTP/1.1")
+	}
+}
+
+func TestTimeEpoch(t *testing.T) {
+	ar := eventWithContext(t, `{"http": {"method": "GET"}, "timeEpoch": 1583348638390}`)
+	if want := time.Date(2020, 3, 4, 19, 3, 58, 390e6, time.UTC); !ar.TimeEpoch().Equal(want) {
+		t.Errorf("TimeEpoch() = %v, want %v", ar.TimeEpoch(), want)
+	}
+	if got := (&AdapterRequest{}).TimeEpoch(); !got.IsZero() {
+		t.Errorf("TimeEpoch() without a request context = %v, want the zero time", got)
+	}
+}
+
+func TestAPIID(t *testing.T) {
+	for name, requestContext := range map[string]string{
+		"v1": `{"apiId": "abc123", "identity": {}}`,
+		"v2": `{"apiId": "abc123", "http": {"method": "GET"}}`,
+	} {
+		if got := eventWithContext(t, requestContext).APIID(); got != "abc123" {
+			t.Errorf("%s: APIID() = %q, want %q", name, got, "abc123")
+		}
+	}
+}
+
+func TestUser(t *testing.T) {
+	if got := eventWithContext(t, `{"identity": {"user": "AIDAEXAMPLE"}}`).User(); got != "AIDAEXAMPLE" {
+		t.Errorf("User() = %q, want %q", got, "AIDAEXAMPLE")
+	}
+}
+
+func TestDomainName(t *testing.T) {
+	for name, requestContext := range map[string]string{
+		"v1": `{"domainName": "api.example.com", "identity": {}}`,
+		"v2": `{"domainName": "api.example.com", "http": {"method": "GET"}}`,
+	} {
+		if got := eventWithContext(t, requestContext).DomainName(); got != "api.example.com" {
+			t.Errorf("%s: DomainName() = %q, want %q", name, got, "api.example.com")
+		}
+	}
+}
+
+func TestCognitoAuthenticationProvider(t *testing.T) {
+	const provider = "cognito-idp.us-east-1.amazonaws.com/us-east-1_aaaaaaaaa,cognito-idp.us-east-1.amazonaws.com/us-east-1_aaaaaaaaa:CognitoSignIn:qqqqqqqq-1111-2222-3333-rrrrrrrrrrrr"
+	ar := eventWithContext(t, `{"identity": {"cognitoAuthenticationProvider": "`+provider+`"}}`)
+	if got := ar.CognitoAuthenticationProvider(); got != provider {
+		t.Errorf("CognitoAuthenticationProvider() = %q, want %q", got, provider)
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	method, p := eventWithContext(t, `{"routeKey": "GET /items/{id}"}`).RouteKey()
+	if method != "GET" || p != "/items/{id}" {
+		t.Errorf("RouteKey() = %q, %q, want %q, %q", method, p, "GET", "/items/{id}")
+	}
+	method, p = eventWithContext(t, `{"routeKey": "$default"}`).RouteKey()
+	if method != "" || p != "$default" {
+		t.Errorf("RouteKey() = %q, %q, want %q, %q", method, p, "", "$default")
+	}
+}
+
+func TestGetAPIGatewayContext(t *testing.T) {
+	ar := eventWithContext(t, `{"accountId": "123456789012", "requestId": "req-1", "identity": {"sourceIp": "203.0.113.7"}}`)
+	ar.HTTPMethod = "GET"
+	ar.Path = "/"
+	ar.Headers = map[string]string{APIGwContextHeader: `{"accountId": "forged"}`}
+	requestContext, err := GetAPIGatewayContext(handlerRequest(t, ar))
+	if err != nil {
+		t.Fatalf("GetAPIGatewayContext: %v", err)
+	}
+	if requestContext.AccountID != "123456789012" || requestContext.RequestID != "req-1" || requestContext.Identity.SourceIP != "203.0.113.7" {
+		t.Errorf("GetAPIGatewayContext() = %+v, want the event's request context", requestContext)
+	}
+
+	if _, err := GetAPIGatewayContext(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Error("GetAPIGatewayContext() of a request without the header didn't fail")
+	}
+}
+
+func TestGetAPIGatewayStageVars(t *testing.T) {
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/", StageVariables: map[string]string{"backend": "https://prod.internal"}}
+	stageVars, err := GetAPIGatewayStageVars(handlerRequest(t, ar))
+	if err != nil || stageVars["backend"] != "https://prod.internal" {
+		t.Errorf("GetAPIGatewayStageVars() = %v, %v, want the event's stage variables", stageVars, err)
+	}
+
+	ar = &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	stageVars, err = GetAPIGatewayStageVars(handlerRequest(t, ar))
+	if err != nil || stageVars == nil || len(stageVars) != 0 {
+		t.Errorf("GetAPIGatewayStageVars() without stage variables = %v, %v, want an empty map", stageVars, err)
+	}
+}
+
+func TestAccountIDs(t *testing.T) {
+	ar := eventWithContext(t, `{"accountId": "111111111111", "identity": {"accountId": "222222222222"}}`)
+	if got := ar.AccountID(); got != "111111111111" {
+		t.Errorf("AccountID() = %q, want the API owner's", got)
+	}
+	if got := ar.IdentityAccountID(); got != "222222222222" {
+		t.Errorf("IdentityAccountID() = %q, want the caller's", got)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	ar := eventWithContext(t, `{"identity": {
+		"cognitoIdentityPoolId": "pool",
+		"accountId": "123456789012",
+		"cognitoIdentityId": "identity",
+		"caller": "AIDAEXAMPLE:session",
+		"apiKey": "key",
+		"apiKeyId": "key-id",
+		"accessKey": "AKIAEXAMPLE",
+		"sourceIp": "203.0.113.7",
+		"cognitoAuthenticationType": "authenticated",
+		"cognitoAuthenticationProvider": "provider",
+		"userArn": "arn:aws:iam::123456789012:user/caller",
+		"userAgent": "curl/8.0",
+		"user": "AIDAEXAMPLE"
+	}}`)
+	identity, err := ar.Identity()
+	if err != nil {
+		t.Fatalf("Identity: %v", err)
+	}
+	want := events.APIGatewayRequestIdentity{
+		CognitoIdentityPoolID:         "pool",
+		AccountID:                     "123456789012",
+		CognitoIdentityID:             "identity",
+		Caller:                        "AIDAEXAMPLE:session",
+		APIKey:                        "key",
+		APIKeyID:                      "key-id",
+		AccessKey:                     "AKIAEXAMPLE",
+		SourceIP:                      "203.0.113.7",
+		CognitoAuthenticationType:     "authenticated",
+		CognitoAuthenticationProvider: "provider",
+		UserArn:                       "arn:aws:iam::123456789012:user/caller",
+		UserAgent:                     "curl/8.0",
+		User:                          "AIDAEXAMPLE",
+	}
+	if identity != want {
+		t.Errorf("Identity() = %+v, want %+v", identity, want)
+	}
+}
+
+func TestV2ClientCert(t *testing.T) {
+	ar := eventWithContext(t, `{"http": {"method": "GET"}, "authentication": {"clientCert": {
+		"clientCertPem": "-----BEGIN CERTIFICATE-----",
+		"subjectDN": "CN=client.example.com,O=Example",
+		"issuerDN": "CN=Example CA",
+		"serialNumber": "01",
+		"validity": {"notBefore": "May 28 12:30:02 2019 GMT", "notAfter": "Aug  5 09:36:04 2021 GMT"}
+	}}}`)
+	cert, err := ar.V2ClientCert()
+	if err != nil {
+		t.Fatalf("V2ClientCert: %v", err)
+	}
+	if cert.SubjectDN != "CN=client.example.com,O=Example" || cert.IssuerDN != "CN=Example CA" {
+		t.Errorf("V2ClientCert() = %+v, want the subject and issuer", cert)
+	}
+	if cert.Validity.NotAfter != "Aug  5 09:36:04 2021 GMT" {
+		t.Errorf("NotAfter = %q", cert.Validity.NotAfter)
+	}
+}
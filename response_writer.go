@@ -0,0 +1,55 @@
+package awseventadapter
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// responseWriter wraps the recorder handed to the handler. The recorder sniffs
+// a Content-Type on the first Write when the handler didn't set one, the same
+// as net/http, which hides whether the handler picked the type. Leaving an
+// empty Content-Type in the header map stops the sniffing, and sniff records
+// that it was the wrapper and not the handler that left it there so
+// newAdapterResponse can decide on the type itself.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	hijacked    bool
+	sniff       bool
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *responseWriter) WriteHeader(statusCode int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write implements http.ResponseWriter
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		h := w.Header()
+		if _, ok := h[contentTypeHeaderKey]; !ok {
+			h[contentTypeHeaderKey] = nil
+			w.sniff = true
+		}
+		w.wroteHeader = true
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, the recorder supports it so handlers expect
+// it to be there
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so a handler trying it gets a clear error,
+// there's no connection behind a Lambda invocation. serveHTTP checks hijacked
+// to turn the response into a 500.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, ErrHijackNotSupported
+}
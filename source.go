@@ -0,0 +1,160 @@
+package awseventadapter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+// EventSource identifies the service that delivered the event
+type EventSource int
+
+const (
+	// SourceUnknown leaves it to the adapter to work out the source
+	SourceUnknown EventSource = iota
+	// SourceAPIGateway is an API Gateway REST API proxy event
+	SourceAPIGateway
+	// SourceALB is an ALB target group event
+	SourceALB
+	// SourceAPIGatewayV2 is an API Gateway HTTP API payload format 2.0 event
+	SourceAPIGatewayV2
+	// SourceLambdaFunctionURL is a Lambda Function URL event, which uses the
+	// payload 2.0 shape without API Gateway in front
+	SourceLambdaFunctionURL
+)
+
+// NewAdapterRequestFromFunctionURL converts a Lambda Function URL event into
+// an AdapterRequest, for handlers that already take the typed event
+func NewAdapterRequestFromFunctionURL(e events.LambdaFunctionURLRequest) (*AdapterRequest, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to marshal LambdaFunctionURLRequest")
+	}
+	ar := &AdapterRequest{}
+	if err := json.Unmarshal(b, ar); err != nil {
+		return nil, errors.Wrap(err, "Unable to unmarshal LambdaFunctionURLRequest into AdapterRequest")
+	}
+	return ar, nil
+}
+
+// Source returns where the event came from. The ExpectedSource option wins
+// when it's set, otherwise a version 2.0 event is from a Function URL when its
+// domain is a lambda-url one and from an HTTP API if not, an event with a
+// `requestContext.elb` block is taken to be from an ALB and anything else from
+// a REST API.
+func (ar *AdapterRequest) Source() EventSource {
+	if source := ar.opts().ExpectedSource; source != SourceUnknown {
+		return source
+	}
+	if source := ar.detectSource(); source != SourceUnknown {
+		return source
+	}
+	return SourceAPIGateway
+}
+
+// detectSource works out the source from the fields in the event, returning
+// SourceUnknown when nothing gives it away
+func (ar *AdapterRequest) detectSource() EventSource {
+	switch {
+	case ar.Version == "2.0" && strings.Contains(ar.DomainName(), ".lambda-url."):
+		return SourceLambdaFunctionURL
+	case ar.Version == "2.0":
+		return SourceAPIGatewayV2
+	case ar.requestContextValue("elb") != nil:
+		return SourceALB
+	case ar.HTTPMethod != "":
+		return SourceAPIGateway
+	}
+	return SourceUnknown
+}
+
+// ErrUnknownEvent is returned by ParseEvent for events it can't place
+var ErrUnknownEvent = errors.New("Unknown event shape")
+
+// Proxyable is an event that can be proxied through an http.Handler
+type Proxyable interface {
+	SetOptions(opts *AdapterOptions)
+	Source() EventSource
+	Proxy(ctx context.Context, handler http.Handler) (*AdapterResponse, error)
+	ProxyEvent(ctx context.Context, handler http.Handler) (interface{}, error)
+}
+
+// ParseEvent takes the raw event and returns it ready to proxy, so one binary
+// can sit behind an ALB, a REST API, an HTTP API or a Function URL. Take a
+// json.RawMessage in the lambda handler and return the result of ProxyEvent.
+// Events that don't look like any of those fail with ErrUnknownEvent.
+func ParseEvent(raw json.RawMessage) (Proxyable, error) {
+	ar := &AdapterRequest{}
+	if err := json.Unmarshal(raw, ar); err != nil {
+		return nil, errors.Wrap(err, "Unable to unmarshal event")
+	}
+	if ar.detectSource() == SourceUnknown {
+		return nil, ErrUnknownEvent
+	}
+	return ar, nil
+}
+
+// Adapter proxies events through a handler with the same options, so they
+// don't have to be set on every request. Its ProxyEvent can be handed to
+// lambda.Start as is.
+type Adapter struct {
+	handler http.Handler
+	options *AdapterOptions
+}
+
+// NewAdapter returns an Adapter proxying events through handler with opts, nil
+// keeps the defaults. The options are shared by every request, don't change
+// them afterwards.
+func NewAdapter(handler http.Handler, opts *AdapterOptions) *Adapter {
+	return &Adapter{handler: handler, options: opts}
+}
+
+// Proxy proxies the request through the adapter's handler, with the adapter's
+// options unless the request has its own from SetOptions
+func (a *Adapter) Proxy(ctx context.Context, ar *AdapterRequest) (*AdapterResponse, error) {
+	if ar.options == nil {
+		ar.SetOptions(a.options)
+	}
+	return ar.Proxy(ctx, a.handler)
+}
+
+// ProxyEvent parses the raw event with ParseEvent, proxies it through the
+// adapter's handler and returns the response type matching the event's Source
+func (a *Adapter) ProxyEvent(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	p, err := ParseEvent(raw)
+	if err != nil {
+		return nil, err
+	}
+	p.SetOptions(a.options)
+	return p.ProxyEvent(ctx, a.handler)
+}
+
+// ProxyEvent is Proxy returning the response type matching the event's
+// Source, ready to be returned from the lambda handler
+func (ar *AdapterRequest) ProxyEvent(ctx context.Context, handler http.Handler) (interface{}, error) {
+	aresp, err := ar.Proxy(ctx, handler)
+	if err != nil {
+		return nil, err
+	}
+	return aresp.EventResponse(ar.Source())
+}
+
+// EventResponse returns the response type matching source, ready to be
+// returned from the lambda handler. Pair it with AdapterRequest.Source.
+func (ar *AdapterResponse) EventResponse(source EventSource) (interface{}, error) {
+	switch source {
+	case SourceAPIGateway:
+		return ar.APIGatewayProxyResponse()
+	case SourceALB:
+		return ar.ALBTargetGroupResponse()
+	case SourceAPIGatewayV2:
+		return ar.APIGatewayV2HTTPResponse()
+	case SourceLambdaFunctionURL:
+		return ar.LambdaFunctionURLResponse()
+	}
+	return nil, errors.Errorf("Unknown event source %d", source)
+}
@@ -0,0 +1,203 @@
+package awseventadapter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestExpectedSource(t *testing.T) {
+	// Nothing in here says ALB or API Gateway
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	if got := ar.Source(); got != SourceAPIGateway {
+		t.Errorf("Source() = %v, want SourceAPIGateway", got)
+	}
+
+	ar.SetOptions(&AdapterOptions{ExpectedSource: SourceALB})
+	if got := ar.Source(); got != SourceALB {
+		t.Errorf("Source() with ExpectedSource = %v, want SourceALB", got)
+	}
+	resp, err := ar.ProxyEvent(context.Background(), respond("text/plain", "ok"))
+	if err != nil {
+		t.Fatalf("ProxyEvent: %v", err)
+	}
+	alb, ok := resp.(events.ALBTargetGroupResponse)
+	if !ok {
+		t.Fatalf("ProxyEvent returned a %T, want events.ALBTargetGroupResponse", resp)
+	}
+	if alb.StatusCode != 200 || alb.Body != "ok" {
+		t.Errorf("ALB response = %d %q, want 200 %q", alb.StatusCode, alb.Body, "ok")
+	}
+}
+
+func TestFunctionURLEvent(t *testing.T) {
+	ar, err := NewAdapterRequestFromFunctionURL(events.LambdaFunctionURLRequest{
+		Version:        "2.0",
+		RawPath:        "/items",
+		RawQueryString: "page=2",
+		Cookies:        []string{"session=abc", "theme=dark"},
+		Headers:        map[string]string{"x-amz-date": "20201014T000000Z"},
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			AccountID:  "123456789012",
+			DomainName: "abcdefg.lambda-url.us-east-1.on.aws",
+			Authorizer: &events.LambdaFunctionURLRequestContextAuthorizerDescription{
+				IAM: &events.LambdaFunctionURLRequestContextAuthorizerIAMDescription{
+					AccessKey: "AKIAEXAMPLE",
+					AccountID: "123456789012",
+					CallerID:  "AIDAEXAMPLE",
+					UserARN:   "arn:aws:iam::123456789012:user/caller",
+				},
+			},
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+				Method:   "GET",
+				Path:     "/items",
+				SourceIP: "203.0.113.7",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAdapterRequestFromFunctionURL: %v", err)
+	}
+	if got := ar.Source(); got != SourceLambdaFunctionURL {
+		t.Errorf("Source() = %v, want SourceLambdaFunctionURL", got)
+	}
+	if got := ar.requestContextString("authorizer", "iam", "userArn"); got != "arn:aws:iam::123456789012:user/caller" {
+		t.Errorf("IAM user ARN = %q, want it kept in the request context", got)
+	}
+
+	resp, err := ar.ProxyEvent(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RemoteAddr != "203.0.113.7:0" {
+			t.Errorf("RemoteAddr = %q, want the source IP", r.RemoteAddr)
+		}
+		if c, err := r.Cookie("theme"); err != nil || c.Value != "dark" {
+			t.Errorf("Cookie(theme) = %v, %v, want dark", c, err)
+		}
+		if r.URL.Path != "/items" || r.URL.RawQuery != "page=2" {
+			t.Errorf("URL = %q, want /items?page=2", r.URL)
+		}
+		http.SetCookie(w, &http.Cookie{Name: "id", Value: "1"})
+		w.Write([]byte("ok"))
+	}))
+	if err != nil {
+		t.Fatalf("ProxyEvent: %v", err)
+	}
+	furl, ok := resp.(events.LambdaFunctionURLResponse)
+	if !ok {
+		t.Fatalf("ProxyEvent returned a %T, want events.LambdaFunctionURLResponse", resp)
+	}
+	if furl.Body != "ok" || len(furl.Cookies) != 1 || furl.Cookies[0] != "id=1" {
+		t.Errorf("Function URL response = %q with cookies %q, want %q with id=1", furl.Body, furl.Cookies, "ok")
+	}
+	if _, ok := furl.Headers["Set-Cookie"]; ok {
+		t.Error("Set-Cookie was left in the headers")
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		event interface{}
+		want  EventSource
+	}{
+		{"REST API", events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/"}, SourceAPIGateway},
+		{"ALB", events.ALBTargetGroupRequest{
+			HTTPMethod:     "GET",
+			Path:           "/",
+			RequestContext: events.ALBTargetGroupRequestContext{ELB: events.ELBContext{TargetGroupArn: "arn"}},
+		}, SourceALB},
+		{"HTTP API", events.APIGatewayV2HTTPRequest{
+			Version:        "2.0",
+			RawPath:        "/",
+			RequestContext: events.APIGatewayV2HTTPRequestContext{HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{Method: "GET"}},
+		}, SourceAPIGatewayV2},
+		{"Function URL", events.LambdaFunctionURLRequest{
+			Version: "2.0",
+			RawPath: "/",
+			RequestContext: events.LambdaFunctionURLRequestContext{
+				DomainName: "abcdefg.lambda-url.us-east-1.on.aws",
+				HTTP:       events.LambdaFunctionURLRequestContextHTTPDescription{Method: "GET"},
+			},
+		}, SourceLambdaFunctionURL},
+	} {
+		raw, err := json.Marshal(tc.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ParseEvent(raw)
+		if err != nil {
+			t.Errorf("%s: ParseEvent: %v", tc.name, err)
+			continue
+		}
+		if got := p.Source(); got != tc.want {
+			t.Errorf("%s: Source() = %v, want %v", tc.name, got, tc.want)
+		}
+		if _, err := p.ProxyEvent(context.Background(), respond("text/plain", "ok")); err != nil {
+			t.Errorf("%s: ProxyEvent: %v", tc.name, err)
+		}
+	}
+
+	if _, err := ParseEvent(json.RawMessage(`{"Records": [{"eventSource": "aws:s3"}]}`)); err != ErrUnknownEvent {
+		t.Errorf("ParseEvent() of an S3 event returned %v, want ErrUnknownEvent", err)
+	}
+	if _, err := ParseEvent(json.RawMessage(`not json`)); err == nil {
+		t.Error("ParseEvent() of invalid JSON didn't fail")
+	}
+}
+
+func TestAdapter(t *testing.T) {
+	var host string
+	a := NewAdapter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.URL.Host
+		w.Write([]byte("ok"))
+	}), &AdapterOptions{ServerAddress: "https://adapter.example.com"})
+
+	resp, err := a.ProxyEvent(context.Background(), json.RawMessage(`{"version": "2.0", "rawPath": "/", "requestContext": {"http": {"method": "GET"}}}`))
+	if err != nil {
+		t.Fatalf("ProxyEvent: %v", err)
+	}
+	if v2, ok := resp.(events.APIGatewayV2HTTPResponse); !ok || v2.Body != "ok" {
+		t.Errorf("ProxyEvent() = %#v, want an HTTP API response", resp)
+	}
+	if host != "adapter.example.com" {
+		t.Errorf("Host = %q, want the adapter's ServerAddress", host)
+	}
+	if _, err := a.ProxyEvent(context.Background(), json.RawMessage(`{}`)); err != ErrUnknownEvent {
+		t.Errorf("ProxyEvent() of an unknown event returned %v, want ErrUnknownEvent", err)
+	}
+
+	// The request's own options win over the adapter's
+	ar := &AdapterRequest{HTTPMethod: "GET", Path: "/"}
+	ar.SetOptions(&AdapterOptions{ServerAddress: "https://request.example.com"})
+	if _, err := a.Proxy(context.Background(), ar); err != nil || host != "request.example.com" {
+		t.Errorf("Proxy() host = %q, %v, want the request's ServerAddress", host, err)
+	}
+}
+
+func TestServerAddressPrecedence(t *testing.T) {
+	a := NewAdapter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Scheme + "://" + r.URL.Host))
+	}), &AdapterOptions{ServerAddress: "https://option.example.com"})
+	defaults := NewAdapter(a.handler, nil)
+	proxy := func(a *Adapter) string {
+		t.Helper()
+		resp, err := a.Proxy(context.Background(), &AdapterRequest{HTTPMethod: "GET", Path: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Body
+	}
+
+	if got := proxy(defaults); got != DefaultServerAddress {
+		t.Errorf("Address with nothing set = %q, want DefaultServerAddress", got)
+	}
+	t.Setenv(CustomHostVariable, "http://env.example.com")
+	if got := proxy(defaults); got != "http://env.example.com" {
+		t.Errorf("Address with %s set = %q, want it", CustomHostVariable, got)
+	}
+	if got := proxy(a); got != "https://option.example.com" {
+		t.Errorf("Address with the option and %s set = %q, want the option", CustomHostVariable, got)
+	}
+}